@@ -1,2 +1,3 @@
 #!/bin/sh
-cd functions && gcloud functions deploy challenge --runtime go113 --trigger-http --entry-point ChallengeHandler --allow-unauthenticated
+cd functions && gcloud functions deploy challenge --runtime go113 --trigger-http --entry-point ChallengeHandler --allow-unauthenticated \
+  && gcloud functions deploy health --runtime go113 --trigger-http --entry-point HealthHandler --allow-unauthenticated
@@ -8,16 +8,40 @@ import (
 )
 
 // ChallengeHandler is a handler for the /challenge endpoint.
-var ChallengeHandler = util.MakeHTTPHandler(challengeHandler)
+var ChallengeHandler = util.MakeHTTPHandler(util.CORS(util.Backpressure(checkChallengeRequest(util.RateLimit(challengeHandler))), "GET"))
 
-func challengeHandler(ctx *util.Context) util.StatusError {
-	if err := util.ValidateRequestMethod(ctx, "GET", ""); err != nil {
-		return err
+// checkChallengeRequest wraps handler, producing a Handler which performs the
+// cheap validation of requests to the /challenge endpoint, so that requests
+// which fail it don't reach the rate limiter.
+func checkChallengeRequest(handler util.Handler) util.Handler {
+	return func(ctx *util.Context) util.StatusError {
+		// Each challenge may only be used once, so it must never be served
+		// from a cache. This is set before any validation so that error
+		// responses (some of which, such as 405, are cacheable by default)
+		// carry it too.
+		ctx.HTTPResponseWriter().Header().Set("Cache-Control", "no-store")
+
+		if err := util.ValidateRequestMethod(ctx, "GET", ""); err != nil {
+			return err
+		}
+		if err := util.ValidateUserAgent(ctx); err != nil {
+			return err
+		}
+
+		ctx.HTTPResponseWriter().Header().Set("Content-Type", "application/json; charset=utf-8")
+		if ctx.HTTPRequest().Method == "HEAD" {
+			// The body would be discarded, so don't spend a rate limit token
+			// or store a challenge which can never be used.
+			return nil
+		}
+		return handler(ctx)
 	}
+}
 
+func challengeHandler(ctx *util.Context) util.StatusError {
 	c, err := pow.GenerateChallenge(ctx)
 	if err != nil {
-		return util.NewInternalServerError(err)
+		return util.FirestoreToStatusError(err)
 	}
 	json.NewEncoder(ctx.HTTPResponseWriter()).Encode(c)
 
@@ -0,0 +1,85 @@
+package functions
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChallengeMethodNotAllowed(t *testing.T) {
+	// Rejected requests must not consult the rate limiter, which would
+	// require Firestore.
+	os.Setenv("RATE_LIMIT_PER_MINUTE", "1")
+	defer os.Unsetenv("RATE_LIMIT_PER_MINUTE")
+	os.Setenv("FIRESTORE_TIMEOUT", "100ms")
+	defer os.Unsetenv("FIRESTORE_TIMEOUT")
+
+	for _, method := range []string{"POST", "PUT", "DELETE"} {
+		w := serveTestHTTP(ChallengeHandler, newTestHTTPRequest(method, "/challenge", nil))
+
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+		assert.Equal(t, "GET, HEAD", w.Header().Get("Allow"))
+		assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	}
+}
+
+func TestChallengeNotCacheable(t *testing.T) {
+	// Stateless challenges don't require Firestore.
+	os.Setenv("POW_CHALLENGE_SECRET", "secret")
+	defer os.Unsetenv("POW_CHALLENGE_SECRET")
+
+	w := serveTestHTTP(ChallengeHandler, newTestHTTPRequest("GET", "/challenge", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"no-store"}, w.Header()["Cache-Control"])
+	for _, h := range []string{"Expires", "ETag", "Last-Modified", "Age"} {
+		assert.Empty(t, w.Header().Get(h), h)
+	}
+}
+
+func TestChallengeHead(t *testing.T) {
+	// Stateless challenges don't require Firestore.
+	os.Setenv("POW_CHALLENGE_SECRET", "secret")
+	defer os.Unsetenv("POW_CHALLENGE_SECRET")
+
+	// Use a real server, since it is the "net/http" package which discards
+	// the bodies of responses to HEAD requests.
+	s := httptest.NewServer(http.HandlerFunc(ChallengeHandler))
+	defer s.Close()
+
+	do := func(method string) (*http.Response, []byte) {
+		r, err := http.NewRequest(method, s.URL+"/challenge", nil)
+		assert.Nil(t, err)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		resp, err := http.DefaultClient.Do(r)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		return resp, body
+	}
+
+	get, body := do("GET")
+	assert.Equal(t, http.StatusOK, get.StatusCode)
+	assert.NotEmpty(t, body)
+
+	// Without a secret, generating a challenge would store it in Firestore,
+	// which is unavailable, and rate limiting would also require Firestore,
+	// so success shows that HEAD requests do neither.
+	os.Unsetenv("POW_CHALLENGE_SECRET")
+	os.Setenv("RATE_LIMIT_PER_MINUTE", "1")
+	defer os.Unsetenv("RATE_LIMIT_PER_MINUTE")
+	os.Setenv("FIRESTORE_TIMEOUT", "100ms")
+	defer os.Unsetenv("FIRESTORE_TIMEOUT")
+
+	head, body := do("HEAD")
+	assert.Equal(t, http.StatusOK, head.StatusCode)
+	assert.Empty(t, body)
+	for _, h := range []string{"Content-Type", "Cache-Control", "Strict-Transport-Security", "Vary"} {
+		assert.Equal(t, get.Header[h], head.Header[h], h)
+	}
+}
@@ -1,25 +1,91 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"upload-token.functions"
-
-	"github.com/GoogleCloudPlatform/functions-framework-go/funcframework"
+	"upload-token.functions/internal/util"
 )
 
+// The time allowed for in-flight requests to complete after a shutdown signal
+// is received if SHUTDOWN_GRACE_PERIOD is unset.
+const defaultShutdownGracePeriod = 10 * time.Second
+
+// shutdownGracePeriod returns the time allowed for in-flight requests to
+// complete after a shutdown signal is received. It is read from the
+// SHUTDOWN_GRACE_PERIOD environment variable, which is parsed using
+// time.ParseDuration. If the variable is unset, or its value is invalid or
+// negative, defaultShutdownGracePeriod is used.
+func shutdownGracePeriod() time.Duration {
+	s := os.Getenv("SHUTDOWN_GRACE_PERIOD")
+	if s == "" {
+		return defaultShutdownGracePeriod
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		util.DefaultLogger.Warningf("ignoring invalid SHUTDOWN_GRACE_PERIOD %q", s)
+		return defaultShutdownGracePeriod
+	}
+	return d
+}
+
+func newServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/challenge", functions.ChallengeHandler)
+	mux.HandleFunc("/health", functions.HealthHandler)
+	mux.HandleFunc("/metrics", functions.MetricsHandler)
+	return mux
+}
+
+// serve serves requests on l using srv until a signal is received on stop. It
+// then stops accepting new connections and waits up to grace for in-flight
+// requests to complete before returning.
+func serve(srv *http.Server, l net.Listener, stop <-chan os.Signal, grace time.Duration) error {
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(l) }()
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		fmt.Printf("Received %v; shutting down\n", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
 func main() {
-	funcframework.RegisterHTTPFunction("/challenge", functions.ChallengeHandler)
 	// Use PORT environment variable, or default to 8080.
 	port := "8080"
 	if envPort := os.Getenv("PORT"); envPort != "" {
 		port = envPort
 	}
 
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatalf("net.Listen: %v\n", err)
+	}
+
+	// Cloud Run and Cloud Functions send SIGTERM before stopping an instance.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
 	fmt.Println("Listening port:", port)
-	if err := funcframework.Start(port); err != nil {
-		log.Fatalf("funcframework.Start: %v\n", err)
+	if err := serve(&http.Server{Handler: newServeMux()}, l, stop, shutdownGracePeriod()); err != nil {
+		log.Fatalf("serve: %v\n", err)
+	}
+	if err := util.CloseFirestoreClient(); err != nil {
+		log.Fatalf("util.CloseFirestoreClient: %v\n", err)
 	}
 }
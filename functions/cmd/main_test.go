@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownGracePeriod(t *testing.T) {
+	defer os.Unsetenv("SHUTDOWN_GRACE_PERIOD")
+
+	type testCase struct {
+		env   string
+		grace time.Duration
+	}
+
+	cases := []testCase{
+		{"", defaultShutdownGracePeriod},
+		{"30s", 30 * time.Second},
+		{"0s", 0},
+		{"-1s", defaultShutdownGracePeriod},
+		{"bogus", defaultShutdownGracePeriod},
+	}
+
+	for _, c := range cases {
+		os.Setenv("SHUTDOWN_GRACE_PERIOD", c.env)
+		assert.Equal(t, c.grace, shutdownGracePeriod(), c.env)
+	}
+}
+
+func TestServeGracefulShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})}
+
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() { served <- serve(srv, l, stop, 5*time.Second) }()
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		responses <- response{string(body), err}
+	}()
+
+	// Signal while the request is in flight.
+	<-started
+	stop <- syscall.SIGTERM
+
+	// The server stops accepting new connections, but waits for the in-flight
+	// request.
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned before the in-flight request completed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, err = net.Dial("tcp", l.Addr().String())
+	assert.NotNil(t, err)
+
+	close(release)
+	resp := <-responses
+	assert.Nil(t, resp.err)
+	assert.Equal(t, "done", resp.body)
+	assert.Nil(t, <-served)
+}
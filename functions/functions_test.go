@@ -0,0 +1,33 @@
+package functions
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Configure the Firestore client to use an emulator so that credentials
+	// are not required. Tests must not perform any Firestore operations
+	// unless they fake them.
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8081")
+	os.Exit(m.Run())
+}
+
+// newTestHTTPRequest constructs a request with the given method, target, and
+// body (which may be nil) which will pass the HTTPS check performed by the
+// handlers in this package.
+func newTestHTTPRequest(method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	return r
+}
+
+// serveTestHTTP serves r using handler, returning the recorded response.
+func serveTestHTTP(handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
@@ -0,0 +1,68 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"upload-token.functions/internal/util"
+)
+
+// HealthHandler is a handler for the /health endpoint, which is intended for
+// load balancers and uptime monitors. It responds with 200 if Firestore is
+// reachable, and 503 otherwise. Since internal probes may not use HTTPS, it
+// accepts plain HTTP requests.
+var HealthHandler = util.MakePlaintextHTTPHandler(healthHandler)
+
+const (
+	// How long to wait for Firestore before declaring it unavailable. This is
+	// deliberately shorter than the usual Firestore timeout so that probes get
+	// a prompt answer.
+	healthCheckTimeout = 2 * time.Second
+
+	// The collection and document read by the health check. The document need
+	// not exist; a NotFound response still demonstrates connectivity.
+	healthCollection = "health"
+	healthDoc        = "sentinel"
+)
+
+// The body of a response from the /health endpoint.
+type healthStatus struct {
+	Status string `json:"status"`
+}
+
+// pingFirestore performs a cheap round-trip to Firestore using client. It is a
+// variable so that tests can replace it.
+var pingFirestore = func(ctx context.Context, client *firestore.Client) error {
+	_, err := client.Collection(healthCollection).Doc(healthDoc).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	return err
+}
+
+func healthHandler(ctx *util.Context) util.StatusError {
+	if err := util.ValidateRequestMethod(ctx, "GET", ""); err != nil {
+		return err
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	w := ctx.HTTPResponseWriter()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := pingFirestore(cctx, ctx.FirestoreClient()); err != nil {
+		ctx.Logger().Errorf("health check failed: %v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(healthStatus{Status: "firestore unavailable"})
+		return nil
+	}
+	json.NewEncoder(w).Encode(healthStatus{Status: "ok"})
+	return nil
+}
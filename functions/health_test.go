@@ -0,0 +1,54 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHealthHandler(t *testing.T) {
+	// The Firestore round-trip is faked.
+	defer func(f func(context.Context, *firestore.Client) error) { pingFirestore = f }(pingFirestore)
+
+	type testCase struct {
+		pingErr    error
+		statusCode int
+		status     string
+	}
+
+	cases := []testCase{
+		{nil, http.StatusOK, "ok"},
+		{status.Error(codes.Unavailable, "unavailable"), http.StatusServiceUnavailable, "firestore unavailable"},
+		{context.DeadlineExceeded, http.StatusServiceUnavailable, "firestore unavailable"},
+		{errors.New("connection refused"), http.StatusServiceUnavailable, "firestore unavailable"},
+	}
+
+	for _, c := range cases {
+		pingFirestore = func(ctx context.Context, _ *firestore.Client) error {
+			_, ok := ctx.Deadline()
+			assert.True(t, ok)
+			return c.pingErr
+		}
+
+		// Plain HTTP is accepted so that internal probes work.
+		for _, proto := range []string{"http", "https"} {
+			r := httptest.NewRequest("GET", "/health", nil)
+			r.Header.Set("X-Forwarded-Proto", proto)
+			w := httptest.NewRecorder()
+			HealthHandler(w, r)
+
+			assert.Equal(t, c.statusCode, w.Code)
+			var body healthStatus
+			assert.Nil(t, json.NewDecoder(w.Body).Decode(&body))
+			assert.Equal(t, c.status, body.Status)
+		}
+	}
+}
@@ -2,17 +2,33 @@
 //
 // The design of this algorithm is described in detail here:
 // https://www.notion.so/covidwatch/Proof-of-Work-Design-1a17cfed3ff74092996c5c4373be71c6
+//
+// By default, every challenge is stored in Firestore when it is generated and
+// deleted when a solution to it is validated, which guarantees that each
+// challenge can only be used once. If the POW_CHALLENGE_SECRET environment
+// variable is set, challenges are instead stateless: each challenge carries its
+// issuance time and an HMAC of its contents keyed by the secret, and validation
+// checks the HMAC and the issuance time instead of consulting Firestore. This
+// avoids a Firestore write and delete per challenge at the cost of allowing a
+// solved challenge to be reused until it expires.
 package pow
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"strconv"
 	"time"
 
+	"cloud.google.com/go/firestore"
 	"golang.org/x/crypto/argon2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"upload-token.functions/internal/util"
 )
@@ -23,9 +39,18 @@ const (
 
 	// Allow challenges to remain valid for one minute to allow for slow
 	// connections. We may need to increase this if we find that there's a tail
-	// of clients whose connections are bad enough that this is too short.
-	expirationPeriod  = 60 * time.Second
-	defaultWorkFactor = 1024
+	// of clients whose connections are bad enough that this is too short. It
+	// can be overridden using the POW_CHALLENGE_TTL environment variable.
+	defaultExpirationPeriod = 60 * time.Second
+	defaultWorkFactor       = 1024
+
+	// The range of work factors which may be configured using the
+	// POW_WORK_FACTOR environment variable. A work factor of 0 would cause
+	// validation to divide by zero, and the expected number of hashes a client
+	// must compute grows linearly with the work factor, so anything much above
+	// the maximum would take clients far longer than defaultExpirationPeriod.
+	minWorkFactor = 1
+	maxWorkFactor = 1 << 20
 
 	// The name of the Firestore collection of challenges.
 	challengeCollection = "challenges"
@@ -37,8 +62,11 @@ const (
 )
 
 var (
-	challengeExpiredError = util.NewBadRequestError(errors.New("proof of work challenge expired"))
-	invalidSolutionError  = util.NewBadRequestError(errors.New("invalid solution to proof of work challenge"))
+	challengeExpiredError  = util.NewBadRequestError(errors.New("proof of work challenge expired"))
+	invalidSolutionError   = util.NewBadRequestError(errors.New("invalid solution to proof of work challenge"))
+	invalidChallengeError  = util.NewBadRequestError(errors.New("invalid proof of work challenge"))
+	malformedSolutionError = util.NewBadRequestError(errors.New("malformed proof of work challenge or solution"))
+	challengeUsedError     = util.NewBadRequestError(errors.New("proof of work challenge already used"))
 )
 
 type nonce [nonceLen]byte
@@ -86,6 +114,34 @@ func (c Challenge) docID() string {
 type challenge struct {
 	Nonce      nonce  `json:"nonce"`
 	WorkFactor uint64 `json:"work_factor"`
+
+	// Issued and MAC are only set for stateless challenges (see the package
+	// documentation). Issued is the time at which the challenge was generated
+	// in seconds since the Unix epoch, and MAC is computed by computeMAC.
+	Issued int64    `json:"issued,omitempty"`
+	MAC    hexBytes `json:"mac,omitempty"`
+}
+
+// hexBytes is a byte slice which is encoded in JSON as a hex string.
+type hexBytes []byte
+
+func (h hexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+func (h *hexBytes) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	bytes, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	*h = bytes
+	return nil
 }
 
 func (c *Challenge) UnmarshalJSON(b []byte) error {
@@ -121,10 +177,55 @@ type ChallengeSolution struct {
 	Solution  Solution  `json:"solution"`
 }
 
-func generateChallenge(workFactor uint64) Challenge {
+func generateChallenge(workFactor uint64) (Challenge, error) {
 	var nonce nonce
-	util.ReadCryptoRandBytes(nonce[:])
-	return Challenge{challenge{nonce, workFactor}}
+	if err := util.TryReadCryptoRandBytes(nonce[:]); err != nil {
+		return Challenge{}, err
+	}
+	return Challenge{challenge{Nonce: nonce, WorkFactor: workFactor}}, nil
+}
+
+// computeMAC computes the HMAC-SHA256 of the nonce, work factor, and issuance
+// time of c keyed by secret.
+func computeMAC(c Challenge, secret []byte) []byte {
+	var buf [nonceLen + 16]byte
+	copy(buf[:], c.inner.Nonce[:])
+	binary.BigEndian.PutUint64(buf[nonceLen:], c.inner.WorkFactor)
+	binary.BigEndian.PutUint64(buf[nonceLen+8:], uint64(c.inner.Issued))
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(buf[:])
+	return mac.Sum(nil)
+}
+
+// signChallenge stamps c with the issuance time now and an HMAC keyed by
+// secret, making it a stateless challenge.
+func signChallenge(c *Challenge, secret []byte, now time.Time) {
+	c.inner.Issued = now.Unix()
+	c.inner.MAC = computeMAC(*c, secret)
+}
+
+// verifyChallenge validates that c was signed by signChallenge using secret,
+// and that it has not expired as of now.
+func verifyChallenge(c Challenge, secret []byte, now time.Time) util.StatusError {
+	if !hmac.Equal(c.inner.MAC, computeMAC(c, secret)) {
+		return invalidChallengeError
+	}
+
+	issued := time.Unix(c.inner.Issued, 0)
+	return validateChallengeDoc(challengeDoc{
+		Issued:     issued,
+		Expiration: issued.Add(expirationPeriod()),
+	}, now)
+}
+
+// challengeSecret returns the secret used to sign stateless challenges, or nil
+// if challenges should be stored in Firestore.
+func challengeSecret() []byte {
+	if s := os.Getenv("POW_CHALLENGE_SECRET"); s != "" {
+		return []byte(s)
+	}
+	return nil
 }
 
 func validateSolution(c Challenge, s Solution) util.StatusError {
@@ -140,62 +241,243 @@ func validateSolution(c Challenge, s Solution) util.StatusError {
 	return nil
 }
 
+// verifySolution calls validateSolution, recording the time it takes in
+// util.DefaultMetrics. c must be a challenge which we issued.
+func verifySolution(c Challenge, s Solution) util.StatusError {
+	start := time.Now()
+	err := validateSolution(c, s)
+	util.DefaultMetrics.ObservePoWVerification(c.inner.WorkFactor, time.Since(start))
+	return err
+}
+
+// checkChallengeSolution performs cheap structural validation of cs so that
+// obviously malformed submissions can be rejected without consulting the
+// database or performing the expensive hash in validateSolution. stateless
+// indicates whether challenges are signed (see the package documentation).
+func checkChallengeSolution(cs *ChallengeSolution, stateless bool) util.StatusError {
+	c, s := cs.Challenge.inner, cs.Solution.inner
+	var zero nonce
+	switch {
+	case c.Nonce == zero, s.Nonce == zero:
+		// We never generate an all-zero nonce (except with negligible
+		// probability), and a missing nonce decodes to all zeroes.
+		return malformedSolutionError
+	case c.WorkFactor < minWorkFactor, c.WorkFactor > maxWorkFactor:
+		// We never issue challenges outside of this range, and a work factor
+		// of 0 would cause validateSolution to divide by zero.
+		return malformedSolutionError
+	case stateless && (len(c.MAC) != sha256.Size || c.Issued <= 0):
+		return malformedSolutionError
+	case !stateless && (c.MAC != nil || c.Issued != 0):
+		// A signed challenge can't have come from this configuration.
+		return malformedSolutionError
+	}
+	return nil
+}
+
 // The document stored in Firebase for a given challenge. Its ID is given by
 // Challenge.docID.
 type challengeDoc struct {
+	// The time at which the challenge was generated.
+	Issued time.Time
+	// The time after which solutions to the challenge are no longer accepted.
 	Expiration time.Time
 }
 
-// GenerateChallenge generates a new challenge and stores it in the database.
+// expirationPeriod returns the period for which newly-generated challenges
+// remain valid. It is read from the POW_CHALLENGE_TTL environment variable,
+// which is parsed using time.ParseDuration. If the variable is unset, or its
+// value is invalid or not positive, defaultExpirationPeriod is used.
+func expirationPeriod() time.Duration {
+	s := os.Getenv("POW_CHALLENGE_TTL")
+	if s == "" {
+		return defaultExpirationPeriod
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		util.DefaultLogger.Warningf("ignoring invalid POW_CHALLENGE_TTL %q: %v", s, err)
+		return defaultExpirationPeriod
+	}
+	if d <= 0 {
+		util.DefaultLogger.Warningf("ignoring non-positive POW_CHALLENGE_TTL %v", d)
+		return defaultExpirationPeriod
+	}
+	return d
+}
+
+func newChallengeDoc(now time.Time) challengeDoc {
+	return challengeDoc{Issued: now, Expiration: now.Add(expirationPeriod())}
+}
+
+// createChallengeDoc stores doc as the document for the challenge with the
+// given ID, failing if it already exists. It is a variable so that tests can
+// replace it.
+var createChallengeDoc = func(ctx *util.Context, id string, doc challengeDoc) error {
+	fctx, cancel := ctx.WithFirestoreTimeout()
+	defer cancel()
+	start := time.Now()
+	_, err := ctx.FirestoreClient().Collection(challengeCollection).Doc(id).Create(fctx, doc)
+	util.RecordFirestoreLatency(start)
+	return err
+}
+
+// getChallengeDoc fetches the document for the challenge with the given ID. It
+// is a variable so that tests can replace it.
+var getChallengeDoc = func(ctx *util.Context, id string) (challengeDoc, error) {
+	fctx, cancel := ctx.WithFirestoreTimeout()
+	defer cancel()
+	start := time.Now()
+	snapshot, err := ctx.FirestoreClient().Collection(challengeCollection).Doc(id).Get(fctx)
+	util.RecordFirestoreLatency(start)
+	if err != nil {
+		return challengeDoc{}, err
+	}
+
+	var doc challengeDoc
+	err = snapshot.DataTo(&doc)
+	return doc, err
+}
+
+// deleteChallengeDoc deletes the document for the challenge with the given ID.
+// It fails with NotFound if the document doesn't exist, so that of several
+// concurrent requests which read the same document, only one can delete it.
+// It is a variable so that tests can replace it.
+var deleteChallengeDoc = func(ctx *util.Context, id string) error {
+	fctx, cancel := ctx.WithFirestoreTimeout()
+	defer cancel()
+	start := time.Now()
+	_, err := ctx.FirestoreClient().Collection(challengeCollection).Doc(id).Delete(fctx, firestore.Exists)
+	util.RecordFirestoreLatency(start)
+	return err
+}
+
+// validateChallengeDoc validates that the challenge described by doc has not
+// expired as of now.
+func validateChallengeDoc(doc challengeDoc, now time.Time) util.StatusError {
+	if doc.Expiration.Before(now) {
+		return challengeExpiredError
+	}
+	return nil
+}
+
+// workFactor returns the work factor to use for newly-generated challenges. It
+// is read from the POW_WORK_FACTOR environment variable each time it is called
+// so that it can be tuned per deployment. If the variable is unset, or its
+// value is invalid or out of range, defaultWorkFactor is used.
+func workFactor() uint64 {
+	s := os.Getenv("POW_WORK_FACTOR")
+	if s == "" {
+		return defaultWorkFactor
+	}
+
+	wf, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		util.DefaultLogger.Warningf("ignoring invalid POW_WORK_FACTOR %q: %v", s, err)
+		return defaultWorkFactor
+	}
+	if wf < minWorkFactor || wf > maxWorkFactor {
+		util.DefaultLogger.Warningf("ignoring out-of-range POW_WORK_FACTOR %v (must be in [%v, %v])",
+			wf, minWorkFactor, maxWorkFactor)
+		return defaultWorkFactor
+	}
+	return wf
+}
+
+// GenerateChallenge generates a new challenge. Unless challenges are stateless
+// (see the package documentation), it is stored in the database.
 func GenerateChallenge(ctx *util.Context) (*Challenge, error) {
-	c := generateChallenge(defaultWorkFactor)
+	sctx, span := util.StartSpan(ctx, "pow.GenerateChallenge")
+	defer span.End()
+	ctx = ctx.WithContext(sctx)
+
+	// Use a single timestamp so that the challenge's issuance time,
+	// expiration, and surge bucket agree.
+	now := ctx.RequestTime()
+	wf, err := currentWorkFactor(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttribute("work_factor", wf)
 
-	doc := challengeDoc{Expiration: time.Now().Add(expirationPeriod)}
-	_, err := ctx.FirestoreClient().Collection(challengeCollection).Doc(c.docID()).Create(ctx, doc)
+	c, err := generateChallenge(wf)
 	if err != nil {
 		return nil, err
 	}
+	if secret := challengeSecret(); secret != nil {
+		signChallenge(&c, secret, now)
+		return &c, nil
+	}
+
+	if err := createChallengeDoc(ctx, c.docID(), newChallengeDoc(now)); err != nil {
+		return nil, err
+	}
 
 	return &c, nil
 }
 
 // ValidateSolution validates a challenge solution. In particular, it validates
 // that:
+//  - The challenge and solution are well-formed
 //  - The challenge is one which we previously generated
 //  - The challenge has not expired
 //  - The solution is valid
 //
+// Well-formedness is checked first since it is cheap, so malformed submissions
+// are rejected without consulting the database or hashing.
+//
 // If the challenge is found in the database, it is deleted so that it cannot be
-// reused.
+// reused. If challenges are stateless (see the package documentation), the
+// database is not consulted; instead, the challenge's HMAC is verified.
+//
+// The outcome, and the time taken to verify the solution itself, are recorded
+// in util.DefaultMetrics.
 func ValidateSolution(ctx *util.Context, cs *ChallengeSolution) util.StatusError {
-	doc := ctx.FirestoreClient().Collection(challengeCollection).Doc(cs.Challenge.docID())
-	snapshot, err := doc.Get(ctx)
-	if err != nil {
-		return util.FirestoreToStatusError(err)
+	err := validateChallengeSolution(ctx, cs)
+	util.DefaultMetrics.ObservePoWValidation(err == nil)
+	return err
+}
+
+// validateChallengeSolution implements ValidateSolution without recording its
+// outcome.
+func validateChallengeSolution(ctx *util.Context, cs *ChallengeSolution) util.StatusError {
+	if err := checkChallengeSolution(cs, challengeSecret() != nil); err != nil {
+		return err
 	}
 
-	var challengeDoc challengeDoc
-	if err = snapshot.DataTo(&challengeDoc); err != nil {
+	if secret := challengeSecret(); secret != nil {
+		if err := verifyChallenge(cs.Challenge, secret, ctx.Now()); err != nil {
+			return err
+		}
+		return verifySolution(cs.Challenge, cs.Solution)
+	}
+
+	id := cs.Challenge.docID()
+	doc, err := getChallengeDoc(ctx, id)
+	if err != nil {
 		return util.FirestoreToStatusError(err)
 	}
 
 	// Delete the document before we validate. It's important that
-	// ValidateSolution never returns nil if the document hasn't been deleted,
-	// or it would allow a client to re-use the same challenge. It's technically
-	// unnecessary to delete the document if we return an error, but we do it
-	// anyway because:
+	// ValidateSolution never returns nil unless this request deleted the
+	// document, or it would allow a client to re-use the same challenge
+	// (possibly by sending concurrent requests). It's technically unnecessary
+	// to delete the document if we return an error, but we do it anyway
+	// because:
 	// - It's simpler (and thus less bug-prone)
 	// - It could only happen due to a failed challenge (in which case the
 	//   client is buggy) or an expired challenge (in which case the challenge
 	//   should be deleted from the database anyway)
-	if _, err = doc.Delete(ctx); err != nil {
+	if err := deleteChallengeDoc(ctx, id); status.Code(err) == codes.NotFound {
+		// Another request used the challenge since we read it.
+		return challengeUsedError
+	} else if err != nil {
 		return util.FirestoreToStatusError(err)
 	}
 
-	now := time.Now()
-	if challengeDoc.Expiration.Before(now) {
-		return challengeExpiredError
+	if err := validateChallengeDoc(doc, ctx.Now()); err != nil {
+		return err
 	}
 
-	return validateSolution(cs.Challenge, cs.Solution)
+	return verifySolution(cs.Challenge, cs.Solution)
 }
@@ -1,11 +1,25 @@
 package pow
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"io"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"upload-token.functions/internal/util"
 )
 
 func TestValidate(t *testing.T) {
@@ -27,9 +41,118 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+// newTestChallenge calls generateChallenge, failing the test on error.
+func newTestChallenge(t testing.TB, workFactor uint64) Challenge {
+	c, err := generateChallenge(workFactor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestWorkFactor(t *testing.T) {
+	defer os.Unsetenv("POW_WORK_FACTOR")
+
+	type testCase struct {
+		env        string
+		workFactor uint64
+	}
+
+	cases := []testCase{
+		{"", defaultWorkFactor},
+		{"1", 1},
+		{"4096", 4096},
+		{"1048576", maxWorkFactor},
+		{"0", defaultWorkFactor},
+		{"1048577", defaultWorkFactor},
+		{"-1", defaultWorkFactor},
+		{"bogus", defaultWorkFactor},
+	}
+
+	for _, c := range cases {
+		os.Setenv("POW_WORK_FACTOR", c.env)
+		assert.Equal(t, c.workFactor, workFactor())
+
+		// Ensure that the configured work factor is what ends up being sent to
+		// the client.
+		bytes, err := json.Marshal(newTestChallenge(t, workFactor()))
+		assert.Nil(t, err)
+		var cc challenge
+		assert.Nil(t, json.Unmarshal(bytes, &cc))
+		assert.Equal(t, c.workFactor, cc.WorkFactor)
+	}
+}
+
+func TestChallengeExpiration(t *testing.T) {
+	defer os.Unsetenv("POW_CHALLENGE_TTL")
+
+	now := time.Now()
+	for _, env := range []string{"", "bogus", "-1s", "0"} {
+		os.Setenv("POW_CHALLENGE_TTL", env)
+		doc := newChallengeDoc(now)
+		assert.Equal(t, now, doc.Issued)
+		assert.Equal(t, now.Add(defaultExpirationPeriod), doc.Expiration)
+	}
+
+	os.Setenv("POW_CHALLENGE_TTL", "5m")
+	doc := newChallengeDoc(now)
+	assert.Equal(t, now.Add(5*time.Minute), doc.Expiration)
+
+	assert.Nil(t, validateChallengeDoc(doc, now))
+	assert.Nil(t, validateChallengeDoc(doc, now.Add(5*time.Minute)))
+	assert.Equal(t, challengeExpiredError, validateChallengeDoc(doc, now.Add(5*time.Minute+1)))
+}
+
+func TestSignedChallenge(t *testing.T) {
+	secret := []byte("secret")
+	// Issuance times have a granularity of one second.
+	now := time.Unix(time.Now().Unix(), 0)
+
+	newChallenge := func() Challenge {
+		c := newTestChallenge(t, defaultWorkFactor)
+		signChallenge(&c, secret, now)
+		return c
+	}
+
+	// Ensure that a signed challenge survives a JSON round trip.
+	c := newChallenge()
+	bytes, err := json.Marshal(c)
+	assert.Nil(t, err)
+	var c1 Challenge
+	assert.Nil(t, json.Unmarshal(bytes, &c1))
+	assert.Equal(t, c, c1)
+	assert.Nil(t, verifyChallenge(c1, secret, now))
+	assert.Nil(t, verifyChallenge(c1, secret, now.Add(defaultExpirationPeriod)))
+
+	assert.Equal(t, challengeExpiredError, verifyChallenge(c, secret, now.Add(defaultExpirationPeriod+time.Second)))
+	assert.Equal(t, invalidChallengeError, verifyChallenge(c, []byte("other secret"), now))
+
+	tampers := []func(c *Challenge){
+		func(c *Challenge) { c.inner.Issued++ },
+		func(c *Challenge) { c.inner.WorkFactor = 1 },
+		func(c *Challenge) { c.inner.Nonce[0]++ },
+		func(c *Challenge) { c.inner.MAC[0]++ },
+		func(c *Challenge) { c.inner.MAC = nil },
+	}
+
+	for _, tamper := range tampers {
+		c := newChallenge()
+		tamper(&c)
+		assert.Equal(t, invalidChallengeError, verifyChallenge(c, secret, now))
+	}
+
+	// Unsigned challenges don't include the stateless fields.
+	bytes, err = json.Marshal(newTestChallenge(t, defaultWorkFactor))
+	assert.Nil(t, err)
+	var m map[string]interface{}
+	assert.Nil(t, json.Unmarshal(bytes, &m))
+	assert.NotContains(t, m, "issued")
+	assert.NotContains(t, m, "mac")
+}
+
 // On a 2018 MacBook Pro, this takes ~930us per validation.
 func BenchmarkValidate(b *testing.B) {
-	c := generateChallenge(defaultWorkFactor)
+	c := newTestChallenge(b, defaultWorkFactor)
 	var s Solution
 	for {
 		_, err := rand.Read(s.inner.Nonce[:])
@@ -51,3 +174,331 @@ func BenchmarkGenerate(b *testing.B) {
 		generateChallenge(defaultWorkFactor)
 	}
 }
+
+func TestCheckChallengeSolution(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Unix(time.Now().Unix(), 0)
+
+	newChallengeSolution := func(stateless bool) ChallengeSolution {
+		c := newTestChallenge(t, defaultWorkFactor)
+		if stateless {
+			signChallenge(&c, secret, now)
+		}
+		var s Solution
+		util.ReadCryptoRandBytes(s.inner.Nonce[:])
+		return ChallengeSolution{Challenge: c, Solution: s}
+	}
+
+	for _, stateless := range []bool{false, true} {
+		cs := newChallengeSolution(stateless)
+		assert.Nil(t, checkChallengeSolution(&cs, stateless))
+	}
+
+	type testCase struct {
+		stateless bool
+		tamper    func(cs *ChallengeSolution)
+	}
+
+	cases := []testCase{
+		{false, func(cs *ChallengeSolution) { cs.Challenge.inner.Nonce = nonce{} }},
+		{false, func(cs *ChallengeSolution) { cs.Solution.inner.Nonce = nonce{} }},
+		{false, func(cs *ChallengeSolution) { cs.Challenge.inner.WorkFactor = 0 }},
+		{false, func(cs *ChallengeSolution) { cs.Challenge.inner.WorkFactor = maxWorkFactor + 1 }},
+		// Signed challenges are rejected when challenges are stored.
+		{false, func(cs *ChallengeSolution) { cs.Challenge.inner.MAC = make([]byte, sha256.Size) }},
+		{false, func(cs *ChallengeSolution) { cs.Challenge.inner.Issued = now.Unix() }},
+		// Unsigned or truncated challenges are rejected when challenges are
+		// signed.
+		{true, func(cs *ChallengeSolution) { cs.Challenge.inner.MAC = nil }},
+		{true, func(cs *ChallengeSolution) { cs.Challenge.inner.MAC = cs.Challenge.inner.MAC[:16] }},
+		{true, func(cs *ChallengeSolution) { cs.Challenge.inner.Issued = 0 }},
+		{true, func(cs *ChallengeSolution) { cs.Challenge.inner.WorkFactor = 0 }},
+	}
+
+	for _, c := range cases {
+		cs := newChallengeSolution(c.stateless)
+		c.tamper(&cs)
+		assert.Equal(t, malformedSolutionError, checkChallengeSolution(&cs, c.stateless))
+	}
+
+	// Malformed submissions are rejected by ValidateSolution before the
+	// database is consulted (ctx has no Firestore client).
+	cs := newChallengeSolution(false)
+	cs.Challenge.inner.WorkFactor = 0
+	assert.Equal(t, malformedSolutionError, ValidateSolution(&util.Context{}, &cs))
+}
+
+func TestGenerateChallengeRequestTime(t *testing.T) {
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8081")
+	defer os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+	// Stateless challenges don't require Firestore.
+	os.Setenv("POW_CHALLENGE_SECRET", "secret")
+	defer os.Unsetenv("POW_CHALLENGE_SECRET")
+
+	// A clock which advances by a second every time it is read.
+	fake := time.Unix(1589414399, 0)
+	clock := func() time.Time {
+		fake = fake.Add(time.Second)
+		return fake
+	}
+
+	r := httptest.NewRequest("GET", "/challenge", nil)
+	ctx, err := util.NewContext(httptest.NewRecorder(), r, util.WithClock(clock))
+	assert.Nil(t, err)
+
+	c, gerr := GenerateChallenge(&ctx)
+	assert.Nil(t, gerr)
+	assert.Equal(t, ctx.RequestTime().Unix(), c.inner.Issued)
+	assert.Equal(t, int64(1589414400), c.inner.Issued)
+}
+
+func TestValidateSolutionMetrics(t *testing.T) {
+	defer func(m *util.Metrics) { util.DefaultMetrics = m }(util.DefaultMetrics)
+	util.DefaultMetrics = util.NewMetrics()
+
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8081")
+	defer os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+	// Stateless challenges don't require Firestore.
+	os.Setenv("POW_CHALLENGE_SECRET", "secret")
+	defer os.Unsetenv("POW_CHALLENGE_SECRET")
+	os.Setenv("POW_WORK_FACTOR", "4")
+	defer os.Unsetenv("POW_WORK_FACTOR")
+
+	r := httptest.NewRequest("POST", "/report", nil)
+	ctx, err := util.NewContext(httptest.NewRecorder(), r)
+	assert.Nil(t, err)
+	c, gerr := GenerateChallenge(&ctx)
+	assert.Nil(t, gerr)
+
+	var s Solution
+	for {
+		util.ReadCryptoRandBytes(s.inner.Nonce[:])
+		if validateSolution(*c, s) == nil {
+			break
+		}
+	}
+
+	assert.Nil(t, ValidateSolution(&ctx, &ChallengeSolution{Challenge: *c, Solution: s}))
+	assert.Equal(t, uint64(1), util.DefaultMetrics.PoWVerificationCount(4))
+	assert.Equal(t, uint64(1), util.DefaultMetrics.PoWValidationCount(true))
+
+	// Solutions to challenges which we didn't issue are counted as failures,
+	// but their work factors are not tracked.
+	forged := *c
+	forged.inner.WorkFactor = 8
+	assert.NotNil(t, ValidateSolution(&ctx, &ChallengeSolution{Challenge: forged, Solution: s}))
+	assert.Equal(t, uint64(0), util.DefaultMetrics.PoWVerificationCount(8))
+	assert.Equal(t, uint64(1), util.DefaultMetrics.PoWValidationCount(false))
+}
+
+// fakeChallengeDocs fakes the Firestore collection of challenges, replacing
+// createChallengeDoc, getChallengeDoc, and deleteChallengeDoc until the
+// function returned by install is called. Like the real deleteChallengeDoc,
+// deleting a document which doesn't exist fails with NotFound.
+type fakeChallengeDocs struct {
+	mu   sync.Mutex
+	docs map[string]challengeDoc
+	// If non-nil, called after each successful get.
+	afterGet func()
+}
+
+func (f *fakeChallengeDocs) install() (restore func()) {
+	create, get, del := createChallengeDoc, getChallengeDoc, deleteChallengeDoc
+	f.docs = make(map[string]challengeDoc)
+
+	createChallengeDoc = func(ctx *util.Context, id string, doc challengeDoc) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.docs[id] = doc
+		return nil
+	}
+	getChallengeDoc = func(ctx *util.Context, id string) (challengeDoc, error) {
+		f.mu.Lock()
+		doc, ok := f.docs[id]
+		f.mu.Unlock()
+		if !ok {
+			return challengeDoc{}, status.Error(codes.NotFound, "not found")
+		}
+		if f.afterGet != nil {
+			f.afterGet()
+		}
+		return doc, nil
+	}
+	deleteChallengeDoc = func(ctx *util.Context, id string) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.docs[id]; !ok {
+			return status.Error(codes.NotFound, "not found")
+		}
+		delete(f.docs, id)
+		return nil
+	}
+
+	return func() {
+		createChallengeDoc, getChallengeDoc, deleteChallengeDoc = create, get, del
+	}
+}
+
+// newSolvableChallenge generates a stored challenge with a work factor of 1, for
+// which every solution is valid, and returns it with a solution.
+func newSolvableChallenge(t *testing.T) *ChallengeSolution {
+	os.Setenv("POW_WORK_FACTOR", "1")
+	defer os.Unsetenv("POW_WORK_FACTOR")
+
+	r := httptest.NewRequest("GET", "/challenge", nil)
+	ctx, err := util.NewContext(httptest.NewRecorder(), r)
+	assert.Nil(t, err)
+	c, gerr := GenerateChallenge(&ctx)
+	if gerr != nil {
+		t.Fatal(gerr)
+	}
+
+	var s Solution
+	s.inner.Nonce[0] = 1
+	return &ChallengeSolution{Challenge: *c, Solution: s}
+}
+
+func TestValidateSolutionDoubleSpend(t *testing.T) {
+	fake := &fakeChallengeDocs{}
+	defer fake.install()()
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8081")
+	defer os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+
+	cs := newSolvableChallenge(t)
+	assert.Len(t, fake.docs, 1)
+
+	r := httptest.NewRequest("POST", "/report", nil)
+	ctx, err := util.NewContext(httptest.NewRecorder(), r)
+	assert.Nil(t, err)
+	assert.Nil(t, ValidateSolution(&ctx, cs))
+	assert.Empty(t, fake.docs)
+
+	// The challenge has been used, so the same solution is rejected.
+	err = ValidateSolution(&ctx, cs)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, util.CodeNotFound, err.Code())
+	}
+}
+
+func TestValidateSolutionConcurrentDoubleSpend(t *testing.T) {
+	fake := &fakeChallengeDocs{}
+	defer fake.install()()
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8081")
+	defer os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+
+	cs := newSolvableChallenge(t)
+
+	// Both requests read the challenge before either deletes it.
+	var read sync.WaitGroup
+	read.Add(2)
+	fake.afterGet = func() {
+		read.Done()
+		read.Wait()
+	}
+
+	errs := make(chan util.StatusError, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			r := httptest.NewRequest("POST", "/report", nil)
+			ctx, err := util.NewContext(httptest.NewRecorder(), r)
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- ValidateSolution(&ctx, cs)
+		}()
+	}
+
+	// Exactly one request may use the challenge.
+	err1, err2 := <-errs, <-errs
+	if err1 != nil {
+		err1, err2 = err2, err1
+	}
+	assert.Nil(t, err1)
+	assert.Equal(t, challengeUsedError, err2)
+}
+
+// spanNameTracer is a util.Tracer which records the name of the current span
+// in the context.
+type spanNameTracer struct{}
+
+type spanNameKey struct{}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(key string, value interface{}) {}
+func (nopSpan) End()                                       {}
+
+func (spanNameTracer) Start(ctx context.Context, name string) (context.Context, util.Span) {
+	return context.WithValue(ctx, spanNameKey{}, name), nopSpan{}
+}
+
+func TestGenerateChallengeSpan(t *testing.T) {
+	defer func(tr util.Tracer) { util.DefaultTracer = tr }(util.DefaultTracer)
+	util.DefaultTracer = spanNameTracer{}
+	fake := &fakeChallengeDocs{}
+	defer fake.install()()
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8081")
+	defer os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+
+	// Firestore operations are performed within the span.
+	var span interface{}
+	create := createChallengeDoc
+	createChallengeDoc = func(ctx *util.Context, id string, doc challengeDoc) error {
+		span = ctx.Value(spanNameKey{})
+		return create(ctx, id, doc)
+	}
+
+	r := httptest.NewRequest("GET", "/challenge", nil)
+	ctx, err := util.NewContext(httptest.NewRecorder(), r)
+	assert.Nil(t, err)
+	_, gerr := GenerateChallenge(&ctx)
+	assert.Nil(t, gerr)
+	assert.Equal(t, "pow.GenerateChallenge", span)
+}
+
+func TestGenerateChallengeRandReader(t *testing.T) {
+	defer func(r io.Reader) { util.RandReader = r }(util.RandReader)
+
+	var want nonce
+	for i := range want {
+		want[i] = byte(i)
+	}
+	util.RandReader = bytes.NewReader(want[:])
+
+	c, err := generateChallenge(defaultWorkFactor)
+	assert.Nil(t, err)
+	assert.Equal(t, want, c.inner.Nonce)
+	assert.Equal(t, "000102030405060708090A0B0C0D0E0F:1024", c.docID())
+}
+
+// errReader is an io.Reader which always fails.
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("entropy unavailable")
+}
+
+func TestGenerateChallengeRandError(t *testing.T) {
+	defer func(r io.Reader) { util.RandReader = r }(util.RandReader)
+	util.RandReader = errReader{}
+
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8081")
+	defer os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+	// Stateless challenges don't require Firestore.
+	os.Setenv("POW_CHALLENGE_SECRET", "secret")
+	defer os.Unsetenv("POW_CHALLENGE_SECRET")
+
+	r := httptest.NewRequest("GET", "/challenge", nil)
+	ctx, serr := util.NewContext(httptest.NewRecorder(), r)
+	assert.Nil(t, serr)
+
+	var c *Challenge
+	var err error
+	assert.NotPanics(t, func() { c, err = GenerateChallenge(&ctx) })
+	assert.Nil(t, c)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "entropy unavailable")
+		assert.Equal(t, http.StatusInternalServerError, util.FirestoreToStatusError(err).HTTPStatusCode())
+	}
+}
@@ -0,0 +1,191 @@
+package pow
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+
+	"upload-token.functions/internal/util"
+)
+
+// During surges in traffic, the work factor is automatically scaled up. We keep
+// a count of the challenges issued during each minute in Firestore, and when
+// the total number issued within the configured window exceeds the configured
+// threshold, the work factor is multiplied by the ratio of the two (rounded
+// up), up to a configured maximum multiplier.
+//
+// Firestore only sustains about one write per second to any one document, and
+// surges are exactly when challenges are issued faster than that, so each
+// minute's count is sharded across countShards documents. Each challenge
+// increments a randomly-chosen shard, and the count is the sum of every shard
+// of every bucket within the window.
+//
+// Surge scaling is disabled unless POW_SURGE_THRESHOLD is set, since it costs
+// extra Firestore operations for every challenge.
+
+const (
+	// The name of the Firestore collection of challenge counts.
+	challengeCountCollection = "challenge_counts"
+	// The granularity with which challenges are counted.
+	countBucketPeriod = time.Minute
+	// The number of documents across which each bucket's count is spread.
+	countShards = 10
+
+	defaultSurgeWindow        = 5 * time.Minute
+	defaultSurgeMaxMultiplier = 16
+)
+
+// The document stored in Firebase for a given shard of a bucket of challenge
+// counts. Its ID is given by countShardID.
+type challengeCountDoc struct {
+	Count int64
+	// The time after which this document is no longer needed.
+	Expiration time.Time
+}
+
+func countShardID(bucket time.Time, shard int) string {
+	return fmt.Sprintf("%d-%d", bucket.Unix(), shard)
+}
+
+// countShardIDs returns the IDs of every shard of every bucket within the
+// window ending at now.
+func countShardIDs(now time.Time, window time.Duration) []string {
+	var ids []string
+	for b := now.Truncate(countBucketPeriod); now.Sub(b) < window; b = b.Add(-countBucketPeriod) {
+		for shard := 0; shard < countShards; shard++ {
+			ids = append(ids, countShardID(b, shard))
+		}
+	}
+	return ids
+}
+
+type surgeConfig struct {
+	// The number of challenges issued within window above which the work
+	// factor is scaled. If it is not positive, scaling is disabled.
+	threshold     int64
+	window        time.Duration
+	maxMultiplier uint64
+}
+
+// getSurgeConfig reads the surge configuration from the POW_SURGE_THRESHOLD,
+// POW_SURGE_WINDOW, and POW_SURGE_MAX_MULTIPLIER environment variables. Invalid
+// values are logged and ignored.
+func getSurgeConfig() surgeConfig {
+	cfg := surgeConfig{
+		window:        defaultSurgeWindow,
+		maxMultiplier: defaultSurgeMaxMultiplier,
+	}
+
+	if s := os.Getenv("POW_SURGE_THRESHOLD"); s != "" {
+		t, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			util.DefaultLogger.Warningf("ignoring invalid POW_SURGE_THRESHOLD %q: %v", s, err)
+		} else {
+			cfg.threshold = t
+		}
+	}
+	if s := os.Getenv("POW_SURGE_WINDOW"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < countBucketPeriod {
+			util.DefaultLogger.Warningf("ignoring invalid POW_SURGE_WINDOW %q (must be at least %v)", s, countBucketPeriod)
+		} else {
+			cfg.window = d
+		}
+	}
+	if s := os.Getenv("POW_SURGE_MAX_MULTIPLIER"); s != "" {
+		m, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || m < 1 {
+			util.DefaultLogger.Warningf("ignoring invalid POW_SURGE_MAX_MULTIPLIER %q", s)
+		} else {
+			cfg.maxMultiplier = m
+		}
+	}
+	return cfg
+}
+
+// scaleWorkFactor scales the work factor base given that count challenges have
+// been issued within cfg.window. The result never exceeds maxWorkFactor unless
+// base does.
+func scaleWorkFactor(base uint64, count int64, cfg surgeConfig) uint64 {
+	if cfg.threshold <= 0 || count <= cfg.threshold {
+		return base
+	}
+
+	// Round up so that any surge above the threshold increases the work
+	// factor.
+	m := uint64((count + cfg.threshold - 1) / cfg.threshold)
+	if m > cfg.maxMultiplier {
+		m = cfg.maxMultiplier
+	}
+	if base > maxWorkFactor/m {
+		if base > maxWorkFactor {
+			return base
+		}
+		return maxWorkFactor
+	}
+	return base * m
+}
+
+// countChallenge records that a challenge was issued at now, and returns the
+// number of challenges issued within the window ending at now (including this
+// one). It is a variable so that tests can replace it.
+var countChallenge = func(ctx *util.Context, now time.Time, window time.Duration) (int64, error) {
+	coll := ctx.FirestoreClient().Collection(challengeCountCollection)
+	fctx, cancel := ctx.WithFirestoreTimeout()
+	defer cancel()
+
+	bucket := now.Truncate(countBucketPeriod)
+	start := time.Now()
+	_, err := coll.Doc(countShardID(bucket, rand.Intn(countShards))).Set(fctx, map[string]interface{}{
+		"Count":      firestore.Increment(1),
+		"Expiration": bucket.Add(window + countBucketPeriod),
+	}, firestore.MergeAll)
+	util.RecordFirestoreLatency(start)
+	if err != nil {
+		return 0, err
+	}
+
+	var refs []*firestore.DocumentRef
+	for _, id := range countShardIDs(now, window) {
+		refs = append(refs, coll.Doc(id))
+	}
+	start = time.Now()
+	snapshots, err := ctx.FirestoreClient().GetAll(fctx, refs)
+	util.RecordFirestoreLatency(start)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for _, snapshot := range snapshots {
+		if !snapshot.Exists() {
+			continue
+		}
+		var doc challengeCountDoc
+		if err := snapshot.DataTo(&doc); err != nil {
+			return 0, err
+		}
+		count += doc.Count
+	}
+	return count, nil
+}
+
+// currentWorkFactor returns the work factor to use for a challenge issued now,
+// taking surge scaling into account.
+func currentWorkFactor(ctx *util.Context, now time.Time) (uint64, error) {
+	base := workFactor()
+	cfg := getSurgeConfig()
+	if cfg.threshold <= 0 {
+		return base, nil
+	}
+
+	count, err := countChallenge(ctx, now, cfg.window)
+	if err != nil {
+		return 0, err
+	}
+	return scaleWorkFactor(base, count, cfg), nil
+}
@@ -0,0 +1,124 @@
+package pow
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"upload-token.functions/internal/util"
+)
+
+func TestScaleWorkFactor(t *testing.T) {
+	cfg := surgeConfig{threshold: 100, window: time.Minute, maxMultiplier: 16}
+
+	type testCase struct {
+		base       uint64
+		count      int64
+		workFactor uint64
+	}
+
+	cases := []testCase{
+		{1024, 0, 1024},
+		{1024, 100, 1024},
+		{1024, 101, 2048},
+		{1024, 200, 2048},
+		{1024, 250, 3072},
+		{1024, 1600, 16384},
+		// The multiplier is capped.
+		{1024, 1000000, 16384},
+		// The work factor is capped.
+		{maxWorkFactor / 2, 1000, maxWorkFactor},
+		{maxWorkFactor + 1, 1000, maxWorkFactor + 1},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.workFactor, scaleWorkFactor(c.base, c.count, cfg))
+	}
+
+	// Scaling is disabled by default.
+	assert.Equal(t, uint64(1024), scaleWorkFactor(1024, 1000000, surgeConfig{}))
+}
+
+func TestGetSurgeConfig(t *testing.T) {
+	vars := []string{"POW_SURGE_THRESHOLD", "POW_SURGE_WINDOW", "POW_SURGE_MAX_MULTIPLIER"}
+	defer func() {
+		for _, v := range vars {
+			os.Unsetenv(v)
+		}
+	}()
+
+	assert.Equal(t, surgeConfig{0, defaultSurgeWindow, defaultSurgeMaxMultiplier}, getSurgeConfig())
+
+	os.Setenv("POW_SURGE_THRESHOLD", "500")
+	os.Setenv("POW_SURGE_WINDOW", "10m")
+	os.Setenv("POW_SURGE_MAX_MULTIPLIER", "4")
+	assert.Equal(t, surgeConfig{500, 10 * time.Minute, 4}, getSurgeConfig())
+
+	os.Setenv("POW_SURGE_THRESHOLD", "bogus")
+	os.Setenv("POW_SURGE_WINDOW", "1s")
+	os.Setenv("POW_SURGE_MAX_MULTIPLIER", "0")
+	assert.Equal(t, surgeConfig{0, defaultSurgeWindow, defaultSurgeMaxMultiplier}, getSurgeConfig())
+}
+
+func TestCountShardIDs(t *testing.T) {
+	now := time.Unix(1590000090, 0)
+	ids := countShardIDs(now, 2*time.Minute)
+	assert.Equal(t, 2*countShards, len(ids))
+	assert.Equal(t, "1590000060-0", ids[0])
+	assert.Equal(t, "1590000000-0", ids[countShards])
+
+	// Every shard of every bucket is distinct.
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		assert.False(t, seen[id], id)
+		seen[id] = true
+	}
+}
+
+func TestCurrentWorkFactor(t *testing.T) {
+	defer func(f func(*util.Context, time.Time, time.Duration) (int64, error)) { countChallenge = f }(countChallenge)
+	defer os.Unsetenv("POW_SURGE_THRESHOLD")
+
+	// A counter seeded with count challenges.
+	var count int64
+	countChallenge = func(ctx *util.Context, now time.Time, window time.Duration) (int64, error) {
+		assert.Equal(t, defaultSurgeWindow, window)
+		count++
+		return count, nil
+	}
+	ctx := &util.Context{}
+	now := time.Now()
+
+	// Challenges aren't counted unless surge scaling is enabled.
+	wf, err := currentWorkFactor(ctx, now)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(defaultWorkFactor), wf)
+	assert.Equal(t, int64(0), count)
+
+	os.Setenv("POW_SURGE_THRESHOLD", "100")
+	wf, err = currentWorkFactor(ctx, now)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(defaultWorkFactor), wf)
+
+	// Once the threshold is exceeded, the work factor rises.
+	count = 100
+	wf, err = currentWorkFactor(ctx, now)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2*defaultWorkFactor), wf)
+
+	count = 299
+	wf, err = currentWorkFactor(ctx, now)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3*defaultWorkFactor), wf)
+
+	// Failing to count challenges is an error.
+	countErr := errors.New("unavailable")
+	countChallenge = func(ctx *util.Context, now time.Time, window time.Duration) (int64, error) {
+		return 0, countErr
+	}
+	_, err = currentWorkFactor(ctx, now)
+	assert.Equal(t, countErr, err)
+}
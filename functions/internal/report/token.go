@@ -1,10 +1,10 @@
 package report
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"strconv"
 	"strings"
 
 	"upload-token.functions/internal/util"
@@ -31,22 +31,32 @@ import (
 // Given these goals, we design tokens with the following properties:
 // - In order to allow tokens to be encoded using as few characters as possible,
 //   they are allocated as close to 0 as possible.
-// - In order to accomodate non-native speakers, for whom letters can be
-//   difficult to pronounce, tokens are encoded in octal.
+// - In order to make tokens easy to read aloud and transcribe, they are encoded
+//   using Crockford's base32 [2]. Its alphabet consists of the digits and the
+//   letters other than I, L, O, and U, which are easily confused with 1, 1, 0,
+//   and V respectively. Parsing is case-insensitive, and treats I and L as 1
+//   and O as 0 so that common transcription mistakes are harmless.
 // - In order to minimize the likelihood that an incorrectly-input token will
 //   be a different but still valid token, we add a 9-bit random key to each
 //   token; this key must match in order for two tokens to be considered equal.
 //   Note that this also minimizes the likelihood of accidental verification
 //   due to an expired token being used since it's unlikely that the same token
 //   will be allocated with the same key.
-// - Since tokens are variable-length, without modification, it would be
-//   ambiguous when somebody is done speaking a token out loud. In order to
-//   eliminate ambiguity, we suffix each encoded token with the digit 9, which
-//   is not a valid octal character, and so can only appear at the end of the
-//   token.
+// - In order to catch transcription errors without a database lookup, we
+//   append a check character computed using the Luhn mod N algorithm [3] over
+//   the base32 alphabet. This detects every single-character substitution and
+//   most transpositions of adjacent characters. Unlike the 9-bit key, the check
+//   character is not part of the token's value.
+// - In order to make tokens easier to dictate, encoded tokens are split into
+//   groups of 4 characters separated by dashes (e.g., "ABCD-EFGH-JK"). Dashes
+//   and spaces are ignored when parsing.
 //
 // [1]
 // https://www.notion.so/covidwatch/Upload-Token-Design-f8566186489e40529c017cdb3356c1b9
+//
+// [2] https://www.crockford.com/base32.html
+//
+// [3] https://en.wikipedia.org/wiki/Luhn_mod_N_algorithm
 
 type UploadToken struct {
 	// The token. The leading 64 - 9 = 55 bits are the ID which identifies a
@@ -89,40 +99,68 @@ func (t UploadToken) key() uint16 {
 	return uint16(t.token & 0x1FF)
 }
 
-const tokenSuffix = "9"
+// The Crockford base32 alphabet.
+const tokenAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
 
-func (t UploadToken) String() string {
-	str := fmt.Sprintf("%o%v", t.token, tokenSuffix)
-
-	// We need at most 22 characters for the octal encoding of a uin64 plus 1
-	// character for the trailing 9 for a total of 23 characters. That results
-	// in at most 8 groups of 3 characters, separated by at most 7 dashes. Thus,
-	// the scratch space must be 23 + 7 = 30 bytes long. However, we also write
-	// a trailing dash (which is later removed), so for that we add an extra
-	// byte.
-	var scratch [31]byte
-	s := scratch[:]
-
-	written := 0
-	for len(str) > 0 {
-		// Chomp at most 3 characters.
-		chomp := 3
-		if len(str) < 3 {
-			chomp = len(str)
+// tokenGroupLen is the number of characters in each dash-separated group of an
+// encoded token.
+const tokenGroupLen = 4
+
+// luhnSum computes the Luhn mod 32 sum of digits, doubling every other digit
+// starting with the rightmost one if doubleLast is true, and starting with the
+// second-rightmost one otherwise.
+func luhnSum(digits []byte, doubleLast bool) int {
+	const n = len(tokenAlphabet)
+
+	sum := 0
+	double := doubleLast
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i])
+		if double {
+			d *= 2
+			d = d/n + d%n
 		}
+		sum += d
+		double = !double
+	}
+	return sum
+}
 
-		copy(s, str[:chomp])
-		// Unconditionally write a dash. This avoids a branch in the loop, and
-		// it's trivial to discard it off after the loop has finished.
-		s[chomp] = '-'
-		written += chomp + 1
+// tokenCheckDigit computes the value of the check character for the given
+// digit values.
+func tokenCheckDigit(digits []byte) byte {
+	const n = len(tokenAlphabet)
+	return byte((n - luhnSum(digits, true)%n) % n)
+}
 
-		str = str[chomp:]
-		s = s[chomp+1:]
+// String encodes t using Crockford's base32 with as few characters as
+// possible followed by a check character, split into groups of tokenGroupLen
+// characters separated by dashes.
+func (t UploadToken) String() string {
+	// A uint64 requires at most 13 base32 characters, plus 1 for the check
+	// character. That results in at most 4 groups, separated by at most 3
+	// dashes, for a total of 17 bytes.
+	var scratch [14]byte
+	i := len(scratch) - 1
+	for n := t.token; ; n >>= 5 {
+		i--
+		scratch[i] = byte(n & 0x1F)
+		if n < 32 {
+			break
+		}
 	}
+	digits := scratch[i:]
+	digits[len(digits)-1] = tokenCheckDigit(digits[:len(digits)-1])
 
-	// Discard the trailing dash.
-	return string(scratch[:written-1])
+	var buf [17]byte
+	s := buf[:0]
+	for j, d := range digits {
+		if j > 0 && j%tokenGroupLen == 0 {
+			s = append(s, '-')
+		}
+		s = append(s, tokenAlphabet[d])
+	}
+	return string(s)
 }
 
 // MarshalJSON implements json.Marshaler.
@@ -136,7 +174,7 @@ func (t *UploadToken) UnmarshalJSON(b []byte) error {
 	if err := json.Unmarshal(b, &s); err != nil {
 		return err
 	}
-	tt, err := parseUploadToken(s)
+	tt, err := ParseUploadToken(s)
 	if err != nil {
 		return err
 	}
@@ -145,17 +183,84 @@ func (t *UploadToken) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-var tokenParseError = util.NewBadRequestError(errors.New("malformed upload token"))
+// MarshalBinary implements encoding.BinaryMarshaler. The binary encoding of a
+// token is its 8-byte big-endian representation. It is intended for
+// constrained clients which prefer fixed-width binary data to the string
+// encoding.
+func (t UploadToken) MarshalBinary() ([]byte, error) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], t.token)
+	return b[:], nil
+}
 
-func parseUploadToken(s string) (UploadToken, error) {
-	s = strings.ReplaceAll(s, "-", "")
-	if !strings.HasSuffix(s, tokenSuffix) {
-		return UploadToken{}, tokenParseError
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (t *UploadToken) UnmarshalBinary(b []byte) error {
+	if len(b) != 8 {
+		return tokenParseError
 	}
+	t.token = binary.BigEndian.Uint64(b)
+	return nil
+}
 
-	n, err := strconv.ParseUint(s[:len(s)-len(tokenSuffix)], 8, 64)
-	if err != nil {
+var (
+	tokenParseError    = util.NewBadRequestError(errors.New("malformed upload token"))
+	tokenChecksumError = util.NewBadRequestError(errors.New("invalid upload token checksum"))
+)
+
+// tokenDigitValue returns the value of the Crockford base32 character c, or -1
+// if c is not a valid character.
+func tokenDigitValue(c byte) int {
+	if c >= 'a' && c <= 'z' {
+		c -= 'a' - 'A'
+	}
+	switch c {
+	case 'O':
+		return 0
+	case 'I', 'L':
+		return 1
+	}
+	return strings.IndexByte(tokenAlphabet, c)
+}
+
+// ParseUploadToken parses an UploadToken from the format produced by
+// UploadToken.String. Parsing is case-insensitive, and dashes and spaces are
+// ignored. If s is malformed, the returned error is a StatusError. In
+// particular, if the check character doesn't match, the error is
+// tokenChecksumError, which allows transcription errors to be detected without
+// consulting the database.
+func ParseUploadToken(s string) (UploadToken, error) {
+	// At most 13 characters for the token plus 1 for the check character.
+	var scratch [14]byte
+	digits := scratch[:0]
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '-' || c == ' ' {
+			continue
+		}
+
+		v := tokenDigitValue(c)
+		if v < 0 || len(digits) == len(scratch) {
+			return UploadToken{}, tokenParseError
+		}
+		digits = append(digits, byte(v))
+	}
+
+	// We need at least one character for the token and one for the check
+	// character.
+	if len(digits) < 2 {
 		return UploadToken{}, tokenParseError
 	}
+	if luhnSum(digits, false)%len(tokenAlphabet) != 0 {
+		return UploadToken{}, tokenChecksumError
+	}
+
+	var n uint64
+	for _, d := range digits[:len(digits)-1] {
+		// Reject values which would overflow a uint64.
+		if n>>59 != 0 {
+			return UploadToken{}, tokenParseError
+		}
+		n = n<<5 | uint64(d)
+	}
 	return UploadToken{token: n}, nil
 }
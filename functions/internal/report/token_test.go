@@ -2,9 +2,15 @@ package report
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"upload-token.functions/internal/util"
 )
 
 func TestNewToken(t *testing.T) {
@@ -40,36 +46,60 @@ func TestTokenFormatParse(t *testing.T) {
 	// For each of the first 2^16 token values, ensure that parsing is the
 	// inverse of formatting.
 	for i := uint64(0); i < 1<<16; i++ {
-		// Test that formatting and parsing are inverses.
-		t0 := UploadToken{token: i}
-		s := t0.String()
-		t1, err := parseUploadToken(s)
-		assert.Nil(t, err)
-		assert.Equal(t, t0, t1)
+		testTokenFormatParse(t, UploadToken{token: i})
+	}
 
-		// Test that JSON marshaling and unmarshaling are inverses.
-		bytes, err := json.Marshal(t0)
-		assert.Nil(t, err)
-		t1 = UploadToken{}
-		err = json.Unmarshal(bytes, &t1)
-		assert.Nil(t, err)
-		assert.Equal(t, t0, t1)
+	// Do the same for random tokens, which exercise longer encodings.
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 1<<16; i++ {
+		testTokenFormatParse(t, UploadToken{token: r.Uint64()})
 	}
 }
 
+func testTokenFormatParse(t *testing.T, t0 UploadToken) {
+	// Test that formatting and parsing are inverses.
+	s := t0.String()
+	t1, err := ParseUploadToken(s)
+	assert.Nil(t, err)
+	assert.Equal(t, t0, t1)
+
+	// Test that parsing is case-insensitive.
+	t1, err = ParseUploadToken(strings.ToLower(s))
+	assert.Nil(t, err)
+	assert.Equal(t, t0, t1)
+
+	// Test that binary marshaling and unmarshaling are inverses.
+	b, err := t0.MarshalBinary()
+	assert.Nil(t, err)
+	assert.Len(t, b, 8)
+	t1 = UploadToken{}
+	assert.Nil(t, t1.UnmarshalBinary(b))
+	assert.Equal(t, t0, t1)
+
+	// Test that JSON marshaling and unmarshaling are inverses.
+	bytes, err := json.Marshal(t0)
+	assert.Nil(t, err)
+	t1 = UploadToken{}
+	err = json.Unmarshal(bytes, &t1)
+	assert.Nil(t, err)
+	assert.Equal(t, t0, t1)
+}
+
 type tokenTestCase struct {
 	token  UploadToken
 	format string
 }
 
 var tokenTestCases = []tokenTestCase{
-	{UploadToken{token: 0}, "09"},
-	{UploadToken{token: 1}, "19"},
-	{UploadToken{token: 8}, "109"},
-	{UploadToken{token: 64}, "100-9"},
-	{UploadToken{token: 512}, "100-09"},
-	{UploadToken{token: 32768}, "100-000-9"},
-	{UploadToken{token: 1<<64 - 1}, "177-777-777-777-777-777-777-79"},
+	{UploadToken{token: 0}, "00"},
+	{UploadToken{token: 1}, "1Y"},
+	{UploadToken{token: 31}, "Z1"},
+	{UploadToken{token: 32}, "10Z"},
+	{UploadToken{token: 513}, "G1E"},
+	{UploadToken{token: 32768}, "1000-Z"},
+	{UploadToken{token: 1048576}, "1000-0Y"},
+	{UploadToken{token: 123456789}, "3NQK-8N1"},
+	{UploadToken{token: 1<<64 - 1}, "FZZZ-ZZZZ-ZZZZ-ZE"},
 }
 
 func TestTokenFormat(t *testing.T) {
@@ -82,12 +112,18 @@ func TestTokenParse(t *testing.T) {
 	// Unlike tokenTestCases, these test cases are only valid in the parsing
 	// direction.
 	cases := []tokenTestCase{
-		{UploadToken{token: 0}, "--0--9--"},
-		{UploadToken{token: 1<<64 - 1}, "17777777777777777777779"},
+		{UploadToken{token: 0}, "--0-0--"},
+		{UploadToken{token: 0}, "0000"},
+		{UploadToken{token: 0}, "oO"},
+		{UploadToken{token: 1}, "IY"},
+		{UploadToken{token: 1}, "ly"},
+		{UploadToken{token: 123456789}, "3nqk 8n1"},
+		{UploadToken{token: 123456789}, " 3NQK-8N1 "},
+		{UploadToken{token: 1<<64 - 1}, "FZZZZZZZZZZZZE"},
 	}
 
 	for _, c := range append(cases, tokenTestCases...) {
-		tok, err := parseUploadToken(c.format)
+		tok, err := ParseUploadToken(c.format)
 		assert.Nil(t, err)
 		assert.Equal(t, c.token, tok)
 	}
@@ -98,13 +134,88 @@ func TestTokenParse(t *testing.T) {
 	}
 
 	errCases := []errorTestCase{
-		{"9", tokenParseError},
 		{"", tokenParseError},
+		{"--", tokenParseError},
+		// A check character alone is not a valid token.
+		{"0", tokenParseError},
+		// U is not part of the alphabet.
+		{"U0", tokenParseError},
+		{"3NQK_8N1", tokenParseError},
+		{"3NQK-8N1!", tokenParseError},
+		// Too long.
+		{"1000-0000-0000-000", tokenParseError},
+		// Overflows a uint64 (and has a valid check character).
+		{"G000-0000-0000-0Z", tokenParseError},
+		// Invalid check character.
+		{"3NQK-8N2", tokenChecksumError},
+		{"3NQK-8M1", tokenChecksumError},
+		{"FZZZ-ZZZZ-ZZZZ-Z", tokenChecksumError},
 	}
 
 	for _, c := range errCases {
-		tok, err := parseUploadToken(c.format)
+		tok, err := ParseUploadToken(c.format)
 		assert.Equal(t, tok, UploadToken{token: 0})
 		assert.Equal(t, err, c.err)
 	}
 }
+
+func TestTokenChecksum(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 1024; i++ {
+		tok := UploadToken{token: r.Uint64() >> uint(r.Intn(64))}
+		s := []byte(tok.String())
+
+		for j, c := range s {
+			if c == '-' {
+				continue
+			}
+
+			// Ensure that substituting any other character is caught by the
+			// checksum.
+			for k := 0; k < len(tokenAlphabet); k++ {
+				if tokenAlphabet[k] == c {
+					continue
+				}
+				typo := append([]byte(nil), s...)
+				typo[j] = tokenAlphabet[k]
+				_, err := ParseUploadToken(string(typo))
+				assert.Equal(t, tokenChecksumError, err, "%v -> %v", string(s), string(typo))
+			}
+		}
+	}
+}
+
+func TestTokenBinary(t *testing.T) {
+	tok := UploadToken{token: 0x0102030405060708}
+	b, err := tok.MarshalBinary()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, b)
+
+	for _, b := range [][]byte{nil, {1, 2, 3, 4, 5, 6, 7}, {1, 2, 3, 4, 5, 6, 7, 8, 9}} {
+		assert.Equal(t, tokenParseError, tok.UnmarshalBinary(b))
+	}
+}
+
+func TestTokenJSON(t *testing.T) {
+	type request struct {
+		UploadToken UploadToken `json:"upload_token"`
+	}
+
+	// Decode a known-good request from a fixture.
+	b, err := ioutil.ReadFile("testdata/upload_token.json")
+	assert.Nil(t, err)
+	var req request
+	assert.Nil(t, json.Unmarshal(b, &req))
+	assert.Equal(t, UploadToken{token: 123456789}, req.UploadToken)
+
+	b, err = json.Marshal(req)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"upload_token":"3NQK-8N1"}`, string(b))
+
+	// Malformed tokens are rejected with a bad request error.
+	for _, s := range []string{`"3NQK-8N2"`, `"U0"`, `""`, `123456789`, `null!`} {
+		err := json.Unmarshal([]byte(`{"upload_token":`+s+`}`), &req)
+		assert.NotNil(t, err)
+		assert.Equal(t, http.StatusBadRequest, util.JSONToStatusError(err).HTTPStatusCode(), s)
+	}
+}
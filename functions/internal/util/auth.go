@@ -0,0 +1,60 @@
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"os"
+	"strings"
+)
+
+// Administrative endpoints are protected by a shared secret, which clients
+// present using an "Authorization: Bearer <token>" header. The secret is
+// configured using the ADMIN_TOKEN environment variable. If it is unset, all
+// requests to administrative endpoints are rejected.
+
+var (
+	missingTokenError = errors.New("missing bearer token")
+	invalidTokenError = errors.New("invalid bearer token")
+)
+
+// bearerToken extracts the token from the value of an Authorization header
+// using the Bearer scheme. The scheme is case-insensitive.
+func bearerToken(header string) (string, bool) {
+	const prefix = "bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	token := strings.TrimSpace(header[len(prefix):])
+	return token, token != ""
+}
+
+// tokensEqual compares a and b in constant time. The tokens are hashed first
+// so that the comparison doesn't leak their lengths.
+func tokensEqual(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// RequireBearerToken wraps handler, producing a Handler which rejects requests
+// with a StatusError whose HTTPStatusCode method returns
+// http.StatusUnauthorized unless they present the token configured as
+// described at the top of this file.
+func RequireBearerToken(handler Handler) Handler {
+	return func(ctx *Context) StatusError {
+		token, ok := bearerToken(ctx.HTTPRequest().Header.Get("Authorization"))
+		if !ok {
+			return NewUnauthorizedError(missingTokenError)
+		}
+
+		expected := os.Getenv("ADMIN_TOKEN")
+		if expected == "" {
+			ctx.Logger().Errorf("rejecting request to administrative endpoint: ADMIN_TOKEN is not configured")
+			return NewUnauthorizedError(invalidTokenError)
+		}
+		if !tokensEqual(token, expected) {
+			return NewUnauthorizedError(invalidTokenError)
+		}
+		return handler(ctx)
+	}
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireBearerToken(t *testing.T) {
+	defer os.Unsetenv("ADMIN_TOKEN")
+
+	var called bool
+	handler := RequireBearerToken(func(ctx *Context) StatusError {
+		called = true
+		return nil
+	})
+
+	type testCase struct {
+		env           string
+		authorization string
+		ok            bool
+	}
+
+	cases := []testCase{
+		{"s3cret", "", false},
+		{"s3cret", "Bearer", false},
+		{"s3cret", "Bearer ", false},
+		{"s3cret", "Basic czNjcmV0", false},
+		{"s3cret", "Bearer wrong", false},
+		{"s3cret", "Bearer s3cre", false},
+		{"s3cret", "Bearer s3cret", true},
+		{"s3cret", "bearer s3cret", true},
+		// If no token is configured, nothing is accepted.
+		{"", "Bearer ", false},
+		{"", "Bearer anything", false},
+	}
+
+	for _, c := range cases {
+		os.Setenv("ADMIN_TOKEN", c.env)
+		r := newTestHTTPRequest("POST", "/admin")
+		if c.authorization != "" {
+			r.Header.Set("Authorization", c.authorization)
+		}
+
+		called = false
+		w := serveTestHTTP(handler, r)
+		assert.Equal(t, c.ok, called, c.authorization)
+		if c.ok {
+			assert.Equal(t, http.StatusOK, w.Code)
+		} else {
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// To protect Firestore when it is saturated, requests can be shed based on
+// recently observed Firestore latency. RunTransaction records the latency of
+// each transaction attempt, and other operations record theirs using
+// RecordFirestoreLatency. When the average latency over the last
+// latencyWindow exceeds FIRESTORE_LATENCY_THRESHOLD, handlers wrapped with
+// Backpressure reject new requests with a 503 instead of adding to the load.
+// Once shedding starts, old samples age out of the window, so requests are
+// admitted again within latencyWindow and fresh samples determine whether the
+// database has recovered. If FIRESTORE_LATENCY_THRESHOLD is unset, shedding is
+// disabled.
+
+const (
+	// The period over which latency is averaged.
+	latencyWindow = 10 * time.Second
+	// The minimum number of samples within latencyWindow required before
+	// requests are shed, so that a single slow transaction doesn't trigger
+	// shedding.
+	minLatencySamples = 5
+	// The maximum number of samples retained, bounding memory use under heavy
+	// load.
+	maxLatencySamples = 1000
+)
+
+var overloadedError = errors.New("database is overloaded")
+
+// latencyThreshold returns the average Firestore transaction latency above
+// which requests are shed. It is read from the FIRESTORE_LATENCY_THRESHOLD
+// environment variable, which is parsed using time.ParseDuration. If the
+// variable is unset, or its value is invalid or not positive, it returns 0,
+// which disables shedding.
+func latencyThreshold() time.Duration {
+	s := os.Getenv("FIRESTORE_LATENCY_THRESHOLD")
+	if s == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		DefaultLogger.Warningf("ignoring invalid FIRESTORE_LATENCY_THRESHOLD %q", s)
+		return 0
+	}
+	return d
+}
+
+type latencySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// latencyTracker records recent latency samples. It is safe for concurrent use.
+type latencyTracker struct {
+	mu sync.Mutex
+	// Ordered by time of recording.
+	samples []latencySample
+}
+
+// firestoreLatency tracks the latency of Firestore operations.
+var firestoreLatency latencyTracker
+
+// RecordFirestoreLatency records that a Firestore operation which started at
+// start has just completed, for use by Backpressure. It should be called after
+// every Firestore operation not performed by RunTransaction, which records its
+// own latency.
+func RecordFirestoreLatency(start time.Time) {
+	firestoreLatency.record(time.Now(), time.Since(start))
+}
+
+// prune discards samples which are too old as of now, or in excess of
+// maxLatencySamples. t.mu must be held.
+func (t *latencyTracker) prune(now time.Time) {
+	i := 0
+	for i < len(t.samples) && now.Sub(t.samples[i].at) > latencyWindow {
+		i++
+	}
+	if n := len(t.samples) - i; n > maxLatencySamples {
+		i += n - maxLatencySamples
+	}
+	t.samples = t.samples[i:]
+}
+
+// record records that an operation completing at now took latency.
+func (t *latencyTracker) record(now time.Time, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples = append(t.samples, latencySample{at: now, latency: latency})
+	t.prune(now)
+}
+
+// saturated returns true if, as of now, there are at least minLatencySamples
+// samples within latencyWindow and their average latency exceeds threshold.
+func (t *latencyTracker) saturated(now time.Time, threshold time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(now)
+	if len(t.samples) < minLatencySamples {
+		return false
+	}
+
+	var total time.Duration
+	for _, s := range t.samples {
+		total += s.latency
+	}
+	return total/time.Duration(len(t.samples)) > threshold
+}
+
+// Backpressure wraps handler, producing a Handler which rejects requests with a
+// StatusError whose HTTPStatusCode method returns
+// http.StatusServiceUnavailable while Firestore is saturated. See the
+// documentation at the top of this file for how saturation is detected.
+func Backpressure(handler Handler) Handler {
+	return func(ctx *Context) StatusError {
+		if threshold := latencyThreshold(); threshold > 0 && firestoreLatency.saturated(time.Now(), threshold) {
+			return NewServiceUnavailableError(overloadedError, latencyWindow)
+		}
+		return handler(ctx)
+	}
+}
@@ -0,0 +1,102 @@
+package util
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyThreshold(t *testing.T) {
+	defer os.Unsetenv("FIRESTORE_LATENCY_THRESHOLD")
+
+	for _, env := range []string{"", "bogus", "0", "-1s"} {
+		os.Setenv("FIRESTORE_LATENCY_THRESHOLD", env)
+		assert.Equal(t, time.Duration(0), latencyThreshold())
+	}
+	os.Setenv("FIRESTORE_LATENCY_THRESHOLD", "500ms")
+	assert.Equal(t, 500*time.Millisecond, latencyThreshold())
+}
+
+func TestLatencyTracker(t *testing.T) {
+	var tracker latencyTracker
+	now := time.Now()
+	threshold := 100 * time.Millisecond
+
+	// Too few samples to decide.
+	for i := 0; i < minLatencySamples-1; i++ {
+		tracker.record(now, time.Second)
+	}
+	assert.False(t, tracker.saturated(now, threshold))
+
+	// Enough slow samples to start shedding.
+	tracker.record(now, time.Second)
+	assert.True(t, tracker.saturated(now, threshold))
+
+	// Fast samples bring the average back down.
+	for i := 0; i < 10*minLatencySamples; i++ {
+		tracker.record(now, time.Millisecond)
+	}
+	assert.False(t, tracker.saturated(now, threshold))
+
+	// Old samples age out of the window.
+	tracker = latencyTracker{}
+	for i := 0; i < minLatencySamples; i++ {
+		tracker.record(now, time.Second)
+	}
+	assert.True(t, tracker.saturated(now, threshold))
+	assert.False(t, tracker.saturated(now.Add(latencyWindow+time.Second), threshold))
+	assert.Empty(t, tracker.samples)
+
+	// The number of retained samples is bounded.
+	for i := 0; i < 2*maxLatencySamples; i++ {
+		tracker.record(now, time.Millisecond)
+	}
+	assert.Len(t, tracker.samples, maxLatencySamples)
+}
+
+func TestRecordFirestoreLatency(t *testing.T) {
+	defer func() { firestoreLatency = latencyTracker{} }()
+	firestoreLatency = latencyTracker{}
+
+	RecordFirestoreLatency(time.Now().Add(-time.Second))
+	if assert.Len(t, firestoreLatency.samples, 1) {
+		assert.True(t, firestoreLatency.samples[0].latency >= time.Second)
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	defer os.Unsetenv("FIRESTORE_LATENCY_THRESHOLD")
+	defer func() { firestoreLatency = latencyTracker{} }()
+
+	called := false
+	handler := Backpressure(func(ctx *Context) StatusError {
+		called = true
+		return nil
+	})
+
+	// Feed synthetic high latencies.
+	now := time.Now()
+	for i := 0; i < minLatencySamples; i++ {
+		firestoreLatency.record(now, 5*time.Second)
+	}
+
+	// Shedding is disabled by default.
+	assert.Nil(t, handler(&Context{}))
+	assert.True(t, called)
+
+	os.Setenv("FIRESTORE_LATENCY_THRESHOLD", "1s")
+	called = false
+	err := handler(&Context{})
+	assert.False(t, called)
+	assert.Equal(t, http.StatusServiceUnavailable, err.HTTPStatusCode())
+	assert.Equal(t, CodeUnavailable, err.Code())
+	assert.Equal(t, "10", err.(headerer).Header().Get("Retry-After"))
+
+	// Below the threshold, requests are admitted.
+	os.Setenv("FIRESTORE_LATENCY_THRESHOLD", "10s")
+	assert.Nil(t, handler(&Context{}))
+	assert.True(t, called)
+}
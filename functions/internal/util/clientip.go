@@ -0,0 +1,108 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Requests reach us through a chain of proxies (on Google Cloud, at least the
+// Google Front End), each of which appends the address of its peer to the
+// X-Forwarded-For header (or an element to the RFC 7239 Forwarded header).
+// Entries earlier in the chain than those appended by our own proxies may have
+// been supplied by the client, so the client's IP address is taken to be the
+// entry appended by the outermost of our proxies: the TRUSTED_PROXY_HOPS-th
+// entry from the end.
+
+// The number of proxies assumed to sit in front of us if TRUSTED_PROXY_HOPS is
+// unset.
+const defaultTrustedProxyHops = 1
+
+// trustedProxyHops returns the number of proxies in front of us which append to
+// X-Forwarded-For. It is read from the TRUSTED_PROXY_HOPS environment variable.
+// If the variable is unset, or its value is invalid, defaultTrustedProxyHops is
+// used. If it is 0, forwarding headers are ignored entirely.
+func trustedProxyHops() int {
+	s := os.Getenv("TRUSTED_PROXY_HOPS")
+	if s == "" {
+		return defaultTrustedProxyHops
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		DefaultLogger.Warningf("ignoring invalid TRUSTED_PROXY_HOPS %q", s)
+		return defaultTrustedProxyHops
+	}
+	return n
+}
+
+// trustedHop returns the entry of hops appended by the outermost of n trusted
+// proxies. If there are fewer than n entries, the request didn't pass through
+// all of our proxies, and so every entry is trusted and the first is used.
+func trustedHop(hops []string, n int) string {
+	if len(hops) < n {
+		return hops[0]
+	}
+	return hops[len(hops)-n]
+}
+
+// forwardedClientIP returns the IP address given by the for parameter of the
+// element of the RFC 7239 Forwarded header value header which was appended by
+// the outermost of n trusted proxies. The parameter may include a port and, for
+// IPv6 addresses, is enclosed in brackets. It returns nil if the header is
+// malformed or the node is obfuscated or "unknown".
+func forwardedClientIP(header string, n int) net.IP {
+	elements, ok := splitUnquoted(header, ',')
+	if !ok {
+		return nil
+	}
+	node, ok := forwardedParam(trustedHop(elements, n), "for")
+	if !ok {
+		return nil
+	}
+
+	if strings.HasPrefix(node, "[") {
+		if i := strings.IndexByte(node, ']'); i > 0 {
+			return net.ParseIP(node[1:i])
+		}
+		return nil
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	return net.ParseIP(node)
+}
+
+// clientIP returns the IP address of the client which sent r, as described at
+// the top of this file. If r wasn't forwarded, or the relevant forwarding
+// header entry isn't a valid IP address, r.RemoteAddr is used.
+func clientIP(r *http.Request) string {
+	if n := trustedProxyHops(); n > 0 {
+		// A proxy may append a new header line rather than extending an
+		// existing one, so all lines must be considered, in order; otherwise,
+		// the hop would be chosen from a line supplied by the client.
+		var ip net.IP
+		if xff := strings.Join(r.Header["X-Forwarded-For"], ","); xff != "" {
+			ip = net.ParseIP(strings.TrimSpace(trustedHop(strings.Split(xff, ","), n)))
+		} else if fwd := strings.Join(r.Header[forwarded], ","); fwd != "" {
+			ip = forwardedClientIP(fwd, n)
+		}
+		if ip != nil {
+			return ip.String()
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ClientIP returns the IP address of the client which sent the request, as
+// described at the top of clientip.go.
+func (c *Context) ClientIP() string {
+	return clientIP(c.req)
+}
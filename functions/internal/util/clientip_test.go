@@ -0,0 +1,86 @@
+package util
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	defer os.Unsetenv("TRUSTED_PROXY_HOPS")
+
+	type testCase struct {
+		hops       string
+		remoteAddr string
+		xff        string
+		forwarded  string
+		ip         string
+	}
+
+	cases := []testCase{
+		{"", "192.0.2.1:1234", "", "", "192.0.2.1"},
+		{"", "[2001:db8::1]:1234", "", "", "2001:db8::1"},
+		{"", "192.0.2.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		// By default, only the last hop, which was added by our proxy, is
+		// trusted.
+		{"", "192.0.2.1:1234", "203.0.113.1, 198.51.100.1", "", "198.51.100.1"},
+		{"", "192.0.2.1:1234", " , ", "", "192.0.2.1"},
+		{"", "192.0.2.1:1234", "bogus", "", "192.0.2.1"},
+		// Behind two proxies, the hop added by the outer one is used, and
+		// earlier (spoofable) hops are ignored.
+		{"2", "192.0.2.1:1234", "10.0.0.1, 203.0.113.1, 198.51.100.1", "", "203.0.113.1"},
+		{"2", "192.0.2.1:1234", "203.0.113.1", "", "203.0.113.1"},
+		// Forwarding headers are ignored when there are no proxies.
+		{"0", "192.0.2.1:1234", "198.51.100.1", "", "192.0.2.1"},
+		{"-1", "192.0.2.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"bogus", "192.0.2.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		// The Forwarded header is used if X-Forwarded-For is absent.
+		{"", "192.0.2.1:1234", "", "for=203.0.113.1, for=198.51.100.1;proto=https", "198.51.100.1"},
+		{"", "192.0.2.1:1234", "", `for="198.51.100.1:4711"`, "198.51.100.1"},
+		{"", "192.0.2.1:1234", "", `for="[2001:db8::2]:4711"`, "2001:db8::2"},
+		{"2", "192.0.2.1:1234", "", "for=10.0.0.1, for=203.0.113.1, for=198.51.100.1", "203.0.113.1"},
+		{"", "192.0.2.1:1234", "", "for=unknown", "192.0.2.1"},
+		{"", "192.0.2.1:1234", "", "for=_hidden", "192.0.2.1"},
+		{"", "192.0.2.1:1234", "", `for="198.51.100.1`, "192.0.2.1"},
+		{"", "192.0.2.1:1234", "", "proto=https", "192.0.2.1"},
+		// X-Forwarded-For takes precedence.
+		{"", "192.0.2.1:1234", "198.51.100.1", "for=203.0.113.1", "198.51.100.1"},
+	}
+
+	for _, c := range cases {
+		os.Setenv("TRUSTED_PROXY_HOPS", c.hops)
+		r := httptest.NewRequest("GET", "/challenge", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if c.forwarded != "" {
+			r.Header.Set("Forwarded", c.forwarded)
+		}
+		assert.Equal(t, c.ip, clientIP(r), "%+v", c)
+
+		ctx := Context{req: r}
+		assert.Equal(t, c.ip, ctx.ClientIP())
+	}
+}
+
+func TestClientIPMultipleHeaderLines(t *testing.T) {
+	defer os.Unsetenv("TRUSTED_PROXY_HOPS")
+	os.Setenv("TRUSTED_PROXY_HOPS", "1")
+
+	// The client supplies the first line, and our proxy appends a second
+	// rather than extending the first. The client's line must not be trusted.
+	r := httptest.NewRequest("GET", "/challenge", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Add("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+	r.Header.Add("X-Forwarded-For", "198.51.100.1")
+	assert.Equal(t, "198.51.100.1", clientIP(r))
+
+	r = httptest.NewRequest("GET", "/challenge", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Add("Forwarded", "for=10.0.0.1")
+	r.Header.Add("Forwarded", "for=198.51.100.1;proto=https")
+	assert.Equal(t, "198.51.100.1", clientIP(r))
+}
@@ -0,0 +1,88 @@
+package util
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cross-origin requests from browsers are supported using CORS. The origins
+// which may make requests are configured using the CORS_ALLOWED_ORIGINS
+// environment variable, which is a comma-separated list of origins (e.g.,
+// "https://app.example.com,https://example.org"), or "*" to allow any origin.
+// Requests with an Origin header not in the list are rejected. If
+// CORS_ALLOWED_ORIGINS is unset, CORS is disabled: Origin headers are ignored
+// and no CORS headers are sent.
+//
+// Since CORS wraps a Handler, requests (including preflight requests) are still
+// subject to the HTTPS requirement and receive HSTS headers from
+// MakeHTTPHandler.
+
+const (
+	// The request headers which clients may send cross-origin.
+	corsAllowedHeaders = "Content-Type, X-Request-Id"
+	// The response headers which clients may read cross-origin.
+	corsExposedHeaders = "Retry-After, X-Request-Id"
+	// How long clients may cache the result of a preflight request.
+	corsMaxAge = 10 * time.Minute
+)
+
+var originNotAllowedError = statusError{
+	code:      http.StatusForbidden,
+	errorCode: CodeOriginNotAllowed,
+	error:     errors.New("origin not allowed"),
+}
+
+// parseOrigins parses a comma-separated list of origins into a set.
+func parseOrigins(s string) map[string]bool {
+	origins := make(map[string]bool)
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins[o] = true
+		}
+	}
+	return origins
+}
+
+// CORS wraps handler, producing a Handler which supports cross-origin requests
+// using the given methods from the origins configured as described at the top
+// of this file. Preflight requests (OPTIONS requests with an
+// Access-Control-Request-Method header) are answered directly without calling
+// handler.
+func CORS(handler Handler, methods ...string) Handler {
+	return func(ctx *Context) StatusError {
+		allowed := os.Getenv("CORS_ALLOWED_ORIGINS")
+		if allowed == "" {
+			return handler(ctx)
+		}
+
+		r := ctx.HTTPRequest()
+		h := ctx.HTTPResponseWriter().Header()
+		h.Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// Not a cross-origin request.
+			return handler(ctx)
+		}
+
+		origins := parseOrigins(allowed)
+		if !origins["*"] && !origins[origin] {
+			return originNotAllowedError
+		}
+		h.Set("Access-Control-Allow-Origin", origin)
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			h.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge/time.Second)))
+			ctx.HTTPResponseWriter().WriteHeader(http.StatusNoContent)
+			return nil
+		}
+
+		h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		return handler(ctx)
+	}
+}
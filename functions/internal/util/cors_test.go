@@ -0,0 +1,87 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS(t *testing.T) {
+	defer os.Unsetenv("CORS_ALLOWED_ORIGINS")
+
+	var called bool
+	handler := CORS(func(ctx *Context) StatusError {
+		called = true
+		return nil
+	}, "POST")
+
+	newRequest := func(method, origin string) *http.Request {
+		r := newTestHTTPRequest(method, "/report")
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		return r
+	}
+
+	// CORS is disabled by default.
+	called = false
+	w := serveTestHTTP(handler, newRequest("POST", "https://app.example.com"))
+	assert.True(t, called)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	os.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com, https://example.org")
+
+	// Preflight requests from allowed origins are answered directly.
+	called = false
+	w = serveTestHTTP(handler, newRequest("OPTIONS", "https://app.example.com"))
+	assert.False(t, called)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "POST", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, corsAllowedHeaders, w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+	assert.Contains(t, w.Header()["Vary"], "Origin")
+	assert.NotEmpty(t, w.Header().Get("Strict-Transport-Security"))
+
+	// Actual requests from allowed origins are passed through.
+	called = false
+	w = serveTestHTTP(handler, newRequest("POST", "https://example.org"))
+	assert.True(t, called)
+	assert.Equal(t, "https://example.org", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, corsExposedHeaders, w.Header().Get("Access-Control-Expose-Headers"))
+
+	// Requests without an Origin are not cross-origin.
+	called = false
+	w = serveTestHTTP(handler, newRequest("POST", ""))
+	assert.True(t, called)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// Disallowed origins are rejected, both for preflight and actual requests.
+	for _, method := range []string{"OPTIONS", "POST"} {
+		called = false
+		w = serveTestHTTP(handler, newRequest(method, "https://evil.example.com"))
+		assert.False(t, called)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	// Preflight requests must still use HTTPS.
+	r := httptest.NewRequest("OPTIONS", "/report", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	w = serveTestHTTP(handler, r)
+	assert.Equal(t, http.StatusTeapot, w.Code)
+
+	// A wildcard allows any origin.
+	os.Setenv("CORS_ALLOWED_ORIGINS", "*")
+	w = serveTestHTTP(handler, newRequest("OPTIONS", "https://evil.example.com"))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://evil.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+}
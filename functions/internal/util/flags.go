@@ -0,0 +1,142 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Feature flags allow new behavior to be enabled for a subset of requests
+// during a rollout.
+//
+// The default value of each flag comes from the FEATURE_FLAGS environment
+// variable, which is a comma-separated list of flags in the same format as the
+// X-Feature-Flags header (see parseFeatureFlags). Requests may override the
+// defaults using the X-Feature-Flags header, but only if they were sent by a
+// trusted proxy. Trusted proxies are configured using the TRUSTED_PROXIES
+// environment variable, which is a comma-separated list of CIDR ranges (e.g.,
+// "10.0.0.0/8,192.168.0.1/32"). If TRUSTED_PROXIES is unset, the header is
+// never honored.
+//
+// TRUSTED_PROXIES is matched against the immediate peer which sent the request,
+// since the header must have been set by one of our own proxies. This is
+// independent of TRUSTED_PROXY_HOPS (see clientip.go), which determines which
+// X-Forwarded-For entry is taken to be the client's IP address.
+
+var featureFlagsHeader = http.CanonicalHeaderKey("X-Feature-Flags")
+
+// parseFeatureFlags parses a comma-separated list of feature flags into flags.
+// Each element is either a flag name, which enables that flag, or a
+// "name=value" pair, where value is parsed using strconv.ParseBool. Malformed
+// elements are ignored.
+func parseFeatureFlags(s string, flags map[string]bool) {
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+
+		name, value := f, true
+		if i := strings.IndexByte(f, '='); i != -1 {
+			v, err := strconv.ParseBool(strings.TrimSpace(f[i+1:]))
+			if err != nil {
+				continue
+			}
+			name, value = strings.TrimSpace(f[:i]), v
+		}
+		flags[name] = value
+	}
+}
+
+// parseCIDRs parses a comma-separated list of CIDR ranges. Malformed ranges are
+// logged and ignored.
+func parseCIDRs(s string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			DefaultLogger.Warningf("ignoring malformed CIDR range %q: %v", c, err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// cidrEnv is an environment variable containing a comma-separated list of CIDR
+// ranges. Its value is only parsed (and malformed ranges logged) when it
+// changes, rather than on every request. It is safe for concurrent use.
+type cidrEnv struct {
+	name string
+
+	mu     sync.Mutex
+	parsed bool
+	value  string
+	nets   []*net.IPNet
+}
+
+// get returns the CIDR ranges in the current value of the variable.
+func (e *cidrEnv) get() []*net.IPNet {
+	value := os.Getenv(e.name)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.parsed || value != e.value {
+		e.parsed, e.value, e.nets = true, value, parseCIDRs(value)
+	}
+	return e.nets
+}
+
+// trustedProxies holds the ranges in the TRUSTED_PROXIES environment variable.
+var trustedProxies = &cidrEnv{name: "TRUSTED_PROXIES"}
+
+// isTrustedPeer returns true if the immediate peer which sent r (as opposed to
+// the client on whose behalf it may have been forwarded) has an IP address
+// within one of the trusted ranges.
+func isTrustedPeer(r *http.Request, trusted []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return containsIP(trusted, net.ParseIP(host))
+}
+
+// containsIP returns true if ip is within one of nets. A nil ip is never
+// contained.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// featureFlags computes the feature flags for r. defaults is in the format of
+// the FEATURE_FLAGS environment variable, and trusted is the list of trusted
+// proxy ranges.
+func featureFlags(r *http.Request, defaults string, trusted []*net.IPNet) map[string]bool {
+	flags := make(map[string]bool)
+	parseFeatureFlags(defaults, flags)
+	if h := r.Header.Get(featureFlagsHeader); h != "" && isTrustedPeer(r, trusted) {
+		parseFeatureFlags(h, flags)
+	}
+	return flags
+}
+
+// requestFeatureFlags computes the feature flags for r using the configuration
+// in the environment.
+func requestFeatureFlags(r *http.Request) map[string]bool {
+	return featureFlags(r, os.Getenv("FEATURE_FLAGS"), trustedProxies.get())
+}
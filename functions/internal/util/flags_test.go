@@ -0,0 +1,82 @@
+package util
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFeatureFlags(t *testing.T) {
+	flags := make(map[string]bool)
+	parseFeatureFlags(" a, b=false,c=1, d=bogus,,e = true ", flags)
+	assert.Equal(t, map[string]bool{"a": true, "b": false, "c": true, "e": true}, flags)
+}
+
+func TestFeatureFlags(t *testing.T) {
+	const trusted = "10.0.0.0/8, bogus"
+
+	type testCase struct {
+		remoteAddr string
+		header     string
+		flags      map[string]bool
+	}
+
+	cases := []testCase{
+		// Without the header, defaults are used regardless of the peer.
+		{"10.1.2.3:1234", "", map[string]bool{"dedup": true}},
+		{"192.168.1.1:1234", "", map[string]bool{"dedup": true}},
+		// A trusted peer may override the defaults.
+		{"10.1.2.3:1234", "dedup=false, signed-tokens", map[string]bool{"dedup": false, "signed-tokens": true}},
+		// An untrusted peer may not.
+		{"192.168.1.1:1234", "dedup=false, signed-tokens", map[string]bool{"dedup": true}},
+		{"garbage", "dedup=false", map[string]bool{"dedup": true}},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/challenge", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.header != "" {
+			r.Header.Set("X-Feature-Flags", c.header)
+		}
+
+		flags := featureFlags(r, "dedup", parseCIDRs(trusted))
+		assert.Equal(t, c.flags, flags)
+
+		ctx := Context{flags: flags}
+		for name, value := range c.flags {
+			assert.Equal(t, value, ctx.Flag(name))
+		}
+		assert.False(t, ctx.Flag("unknown"))
+	}
+}
+
+func TestCIDREnv(t *testing.T) {
+	defer os.Unsetenv("TEST_CIDRS")
+	defer func(l *Logger) { DefaultLogger = l }(DefaultLogger)
+	var buf bytes.Buffer
+	DefaultLogger = NewLogger(&buf)
+
+	e := &cidrEnv{name: "TEST_CIDRS"}
+	assert.Empty(t, e.get())
+
+	// The value is parsed, and malformed ranges are logged, only once.
+	os.Setenv("TEST_CIDRS", "10.0.0.0/8, bogus")
+	for i := 0; i < 3; i++ {
+		nets := e.get()
+		if assert.Len(t, nets, 1) {
+			assert.Equal(t, "10.0.0.0/8", nets[0].String())
+		}
+	}
+	assert.Equal(t, 1, strings.Count(buf.String(), "ignoring malformed CIDR range"))
+
+	// Changes to the value take effect.
+	os.Setenv("TEST_CIDRS", "192.168.0.0/16")
+	nets := e.get()
+	if assert.Len(t, nets, 1) {
+		assert.Equal(t, "192.168.0.0/16", nets[0].String())
+	}
+}
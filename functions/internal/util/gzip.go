@@ -0,0 +1,178 @@
+package util
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Clients may send gzip-compressed request bodies using "Content-Encoding:
+// gzip", which MakeHTTPHandler transparently decompresses, and may ask for
+// gzip-compressed responses using "Accept-Encoding: gzip". Since a small
+// compressed body can expand enormously, decompressed bodies are limited to
+// maxDecompressedBodySize.
+
+// The maximum size, in bytes, of a decompressed request body.
+const maxDecompressedBodySize = 1 << 20
+
+var (
+	unsupportedEncodingError = statusError{
+		code:      http.StatusUnsupportedMediaType,
+		errorCode: CodeUnsupportedMediaType,
+		error:     errors.New(`unsupported content encoding; only "gzip" is supported`),
+		// RFC 7694 recommends advertising the supported encodings.
+		header: http.Header{"Accept-Encoding": {"gzip"}},
+	}
+	bodyTooLargeError = statusError{
+		code:  http.StatusRequestEntityTooLarge,
+		error: fmt.Errorf("decompressed request body exceeds %v bytes", maxDecompressedBodySize),
+	}
+)
+
+// gzipBody is an io.ReadCloser which decompresses a gzip-compressed request
+// body. Errors are returned as StatusErrors so that JSONToStatusError passes
+// them through unchanged.
+type gzipBody struct {
+	body io.ReadCloser
+	// Constructed on the first call to Read rather than up front, since doing
+	// so reads the gzip header from body, and the body must not be read until
+	// the handler has performed its pre-checks (see checkExpect).
+	zr *gzip.Reader
+	// The number of decompressed bytes which may still be read.
+	remaining int64
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.zr == nil {
+		zr, err := gzip.NewReader(b.body)
+		if err != nil {
+			return 0, NewBadRequestError(fmt.Errorf("invalid gzip request body: %v", err))
+		}
+		b.zr = zr
+	}
+
+	// Read one byte more than is allowed so that we can tell whether the limit
+	// has been exceeded.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.zr.Read(p)
+	if int64(n) > b.remaining {
+		n, b.remaining = int(b.remaining), 0
+		return n, bodyTooLargeError
+	}
+	b.remaining -= int64(n)
+	if err != nil && err != io.EOF {
+		err = NewBadRequestError(fmt.Errorf("invalid gzip request body: %v", err))
+	}
+	return n, err
+}
+
+func (b *gzipBody) Close() error {
+	return b.body.Close()
+}
+
+// decompressRequestBody replaces the body of r with a decompressing reader if
+// its Content-Encoding is gzip. It returns a StatusError whose HTTPStatusCode
+// method returns http.StatusUnsupportedMediaType if the body uses any other
+// encoding.
+func decompressRequestBody(r *http.Request) StatusError {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		r.Body = &gzipBody{body: r.Body, remaining: maxDecompressedBodySize}
+		// The body seen by the handler is no longer encoded, and its length
+		// is unknown.
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		return nil
+	default:
+		return unsupportedEncodingError
+	}
+}
+
+// acceptsGzip returns true if the Accept-Encoding header of r permits a
+// gzip-encoded response. An explicit "gzip" entry takes precedence over "*",
+// and either is ignored if its q-value is 0.
+func acceptsGzip(r *http.Request) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, entry := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(entry, ";")
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.ToLower(strings.TrimSpace(p))
+			if strings.HasPrefix(p, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(p[len("q="):], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// gzipResponseWriter is an http.ResponseWriter which gzip-compresses the
+// response body. Responses whose status code doesn't permit a body, and
+// responses which already set a Content-Encoding, are passed through
+// unchanged.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	// Non-nil if the response is being compressed.
+	zw *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if !g.wroteHeader {
+		g.wroteHeader = true
+		bodyAllowed := code >= 200 && code != http.StatusNoContent && code != http.StatusNotModified
+		if bodyAllowed && g.Header().Get("Content-Encoding") == "" {
+			g.Header().Set("Content-Encoding", "gzip")
+			g.Header().Del("Content-Length")
+			g.zw = gzip.NewWriter(g.ResponseWriter)
+		}
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		// The "net/http" package doesn't sniff the Content-Type of responses
+		// with a Content-Encoding, so we have to do it ourselves.
+		if _, ok := g.Header()["Content-Type"]; !ok {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.zw == nil {
+		return g.ResponseWriter.Write(b)
+	}
+	return g.zw.Write(b)
+}
+
+// Close writes any buffered data and the gzip footer. It must be called once
+// the response is complete.
+func (g *gzipResponseWriter) Close() error {
+	if g.zw == nil {
+		return nil
+	}
+	return g.zw.Close()
+}
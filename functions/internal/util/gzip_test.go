@@ -0,0 +1,154 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(b)
+	assert.Nil(t, err)
+	assert.Nil(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestGzipRoundTrip(t *testing.T) {
+	type message struct {
+		Greeting string `json:"greeting"`
+	}
+
+	// Echoes the request body.
+	echo := func(ctx *Context) StatusError {
+		var m message
+		if err := ctx.DecodeStrictJSON(&m); err != nil {
+			return err
+		}
+		json.NewEncoder(ctx.HTTPResponseWriter()).Encode(m)
+		return nil
+	}
+
+	body := gzipBytes(t, []byte(`{"greeting":"hello"}`))
+	r := httptest.NewRequest("POST", "/echo", bytes.NewReader(body))
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("Content-Encoding", "gzip")
+	r.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := serveTestHTTP(echo, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Contains(t, w.Header()["Vary"], "Accept-Encoding")
+	// The Content-Type is sniffed from the uncompressed body.
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	zr, err := gzip.NewReader(w.Body)
+	assert.Nil(t, err)
+	var m message
+	assert.Nil(t, json.NewDecoder(zr).Decode(&m))
+	assert.Equal(t, "hello", m.Greeting)
+
+	// Responses are only compressed for clients which accept it.
+	r = httptest.NewRequest("POST", "/echo", bytes.NewReader(body))
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("Content-Encoding", "gzip")
+	w = serveTestHTTP(echo, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Contains(t, w.Header()["Vary"], "Accept-Encoding")
+	assert.Equal(t, "{\"greeting\":\"hello\"}\n", w.Body.String())
+}
+
+func TestGzipRequestErrors(t *testing.T) {
+	read := func(ctx *Context) StatusError {
+		if _, err := ioutil.ReadAll(ctx.HTTPRequest().Body); err != nil {
+			return JSONToStatusError(err)
+		}
+		return nil
+	}
+
+	type testCase struct {
+		encoding   string
+		body       []byte
+		statusCode int
+		code       string
+	}
+
+	cases := []testCase{
+		{"gzip", gzipBytes(t, []byte("hello")), http.StatusOK, ""},
+		{"identity", []byte("hello"), http.StatusOK, ""},
+		{"br", []byte("hello"), http.StatusUnsupportedMediaType, CodeUnsupportedMediaType},
+		{"gzip", []byte("not gzip"), http.StatusBadRequest, CodeBadRequest},
+		// Truncated.
+		{"gzip", gzipBytes(t, []byte("hello"))[:15], http.StatusBadRequest, CodeBadRequest},
+		// The limit applies to the decompressed body, which compresses well.
+		{"gzip", gzipBytes(t, make([]byte, maxDecompressedBodySize)), http.StatusOK, ""},
+		{"gzip", gzipBytes(t, make([]byte, maxDecompressedBodySize+1)), http.StatusRequestEntityTooLarge, CodePayloadTooLarge},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/echo", bytes.NewReader(c.body))
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("Content-Encoding", c.encoding)
+		w := serveTestHTTP(read, r)
+
+		assert.Equal(t, c.statusCode, w.Code, c.encoding)
+		if c.code != "" {
+			var body struct {
+				Code string `json:"code"`
+			}
+			assert.Nil(t, json.NewDecoder(w.Body).Decode(&body))
+			assert.Equal(t, c.code, body.Code)
+		}
+		if c.statusCode == http.StatusUnsupportedMediaType {
+			assert.Equal(t, "gzip", w.Header().Get("Accept-Encoding"))
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	type testCase struct {
+		header string
+		ok     bool
+	}
+
+	cases := []testCase{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"x-gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"deflate", false},
+		{"*", true},
+		{"gzip;q=0", false},
+		{"gzip;q=0.0, *", false},
+		{"*;q=0", false},
+		{"gzip;q=bogus", false},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/challenge", nil)
+		r.Header.Set("Accept-Encoding", c.header)
+		assert.Equal(t, c.ok, acceptsGzip(r), c.header)
+	}
+}
+
+func TestGzipNoBody(t *testing.T) {
+	r := newTestHTTPRequest("GET", "/challenge")
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := serveTestHTTP(func(ctx *Context) StatusError {
+		ctx.HTTPResponseWriter().WriteHeader(http.StatusNoContent)
+		return nil
+	}, r)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, 0, w.Body.Len())
+}
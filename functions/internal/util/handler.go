@@ -1,9 +1,14 @@
 package util
 
 import (
+	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Handler is a handler for a request to this service. Use MakeHTTPHandler to
@@ -13,40 +18,182 @@ type Handler = func(ctx *Context) StatusError
 
 // MakeHTTPHandler wraps a Handler, producing a handler which can be registered
 // with the "net/http" package. The returned handler is responsible for:
+//  - Assigning the request a correlation ID
+//  - Recording metrics about the request in DefaultMetrics
+//  - Tracing the request using DefaultTracer
+//  - Decompressing gzip-compressed request bodies, and compressing responses
+//    for clients which accept gzip (see gzip.go)
 //  - Constructing a *Context
 //  - Converting any errors into an HTTP response
 func MakeHTTPHandler(handler func(ctx *Context) StatusError) func(http.ResponseWriter, *http.Request) {
+	return makeHTTPHandler(handler, true)
+}
+
+// MakePlaintextHTTPHandler is like MakeHTTPHandler, except that the returned
+// handler also accepts requests made over plain HTTP. It must only be used for
+// endpoints which neither accept nor return sensitive data, such as health
+// checks used by internal probes.
+func MakePlaintextHTTPHandler(handler Handler) func(http.ResponseWriter, *http.Request) {
+	return makeHTTPHandler(handler, false)
+}
+
+func makeHTTPHandler(handler Handler, requireHTTPS bool) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Add HSTS header.
+		// Record the request in DefaultMetrics once it has been handled.
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		w = rec
+		metrics := DefaultMetrics
+		defer func() {
+			metrics.observe(r.URL.Path, rec.status(), time.Since(start))
+		}()
+
+		// Compress the response if the client accepts it.
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			gw := &gzipResponseWriter{ResponseWriter: w}
+			w = gw
+			defer gw.Close()
+		}
+
+		// Echo the request ID so that clients can correlate their requests
+		// with our logs.
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+
+		// Start a span for the request, continuing the caller's trace (if
+		// any). Since NewContext uses r.Context(), spans started by the
+		// handler are children of this one.
+		rctx := r.Context()
+		if sc, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+			rctx = withRemoteSpanContext(rctx, sc)
+		}
+		rctx, span := StartSpan(rctx, r.URL.Path)
+		r = r.WithContext(rctx)
+		span.SetAttribute("endpoint", r.URL.Path)
+		span.SetAttribute("request_id", id)
+		defer func() {
+			span.SetAttribute("status_code", rec.status())
+			span.End()
+		}()
+
+		// Add HSTS and other security headers.
 		addHSTS(w)
+		addSecurityHeaders(w)
 
 		// Reject insecure HTTP requests.
-		if err := checkHTTPS(r); err != nil {
-			writeStatusError(w, r, err)
+		if requireHTTPS {
+			if err := checkHTTPS(r); err != nil {
+				writeStatusError(w, r, id, err)
+				return
+			}
+		}
+
+		// Reject expectations we don't understand. Note that we support
+		// "Expect: 100-continue" implicitly: the "net/http" package only sends
+		// "100 Continue" once the handler starts reading the request body, and
+		// all of our cheap pre-checks (HTTPS, request method, content type)
+		// happen before any handler reads the body. Thus, a request which fails
+		// a pre-check is rejected before the client sends its body.
+		if err := checkExpect(r); err != nil {
+			writeStatusError(w, r, id, err)
+			return
+		}
+
+		if err := decompressRequestBody(r); err != nil {
+			writeStatusError(w, r, id, err)
 			return
 		}
 
 		ctx, err := NewContext(w, r)
 		if err != nil {
-			writeStatusError(w, r, err)
+			writeStatusError(w, r, id, err)
 			return
 		}
+		ctx.requestID = id
+		ctx.logger = requestLogger(r, id)
 
 		if err := handler(&ctx); err != nil {
-			writeStatusError(w, r, err)
+			writeStatusError(w, r, id, err)
 		}
 	}
 }
 
-func writeStatusError(w http.ResponseWriter, r *http.Request, err StatusError) {
+var expectationFailedError = statusError{
+	code:      http.StatusExpectationFailed,
+	errorCode: CodeExpectationFailed,
+	error:     errors.New(`unsupported expectation; only "100-continue" is supported`),
+}
+
+// checkExpect validates that the Expect header of r, if present, is
+// "100-continue".
+func checkExpect(r *http.Request) StatusError {
+	if e := r.Header.Get("Expect"); e != "" && !strings.EqualFold(e, "100-continue") {
+		return expectationFailedError
+	}
+	return nil
+}
+
+var traceparentHeader = http.CanonicalHeaderKey("Traceparent")
+
+var (
+	requestIDHeader = http.CanonicalHeaderKey("X-Request-Id")
+
+	// Request IDs supplied by clients are included in our logs, so we only
+	// accept ones which can't be used to forge log lines.
+	requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+)
+
+// requestID returns the correlation ID for r. If the client supplied a valid
+// ID in the X-Request-Id header, it is used. Otherwise, a random ID is
+// generated.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); requestIDRegex.MatchString(id) {
+		return id
+	}
+
+	var b [16]byte
+	if err := TryReadCryptoRandBytes(b[:]); err != nil {
+		// Request IDs needn't be unpredictable, so rather than failing the
+		// request, fall back to one which is merely likely to be unique.
+		DefaultLogger.Errorf("generating request ID: %v", err)
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func writeStatusError(w http.ResponseWriter, r *http.Request, requestID string, err StatusError) {
 	type response struct {
 		Message string `json:"message"`
+		Code    string `json:"code"`
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	addNoSniff(w)
+	if h, ok := err.(headerer); ok {
+		for k, v := range h.Header() {
+			w.Header()[k] = v
+		}
+	}
 	w.WriteHeader(err.HTTPStatusCode())
-	json.NewEncoder(w).Encode(response{Message: err.Message()})
+	json.NewEncoder(w).Encode(response{Message: err.Message(), Code: err.Code()})
+
+	severity := SeverityWarning
+	if err.HTTPStatusCode() >= 500 {
+		severity = SeverityError
+	}
+	requestLogger(r, requestID).Log(severity, Fields{
+		"status":      err.HTTPStatusCode(),
+		"code":        err.Code(),
+		"method":      r.Method,
+		"url":         r.URL.String(),
+		"remote_addr": r.RemoteAddr,
+		"error":       err.Error(),
+	}, "responding with error code %v and message %q", err.HTTPStatusCode(), err.Message())
+}
 
-	log.Printf("[%v %v %v]: responding with error code %v and message \"%v\" (error: %v)",
-		r.RemoteAddr, r.Method, r.URL, err.HTTPStatusCode(), err.Message(), err)
+// requestLogger returns a *Logger derived from DefaultLogger which adds the
+// request ID and endpoint of r to every entry.
+func requestLogger(r *http.Request, requestID string) *Logger {
+	return DefaultLogger.With(Fields{"request_id": requestID, "endpoint": r.URL.Path})
 }
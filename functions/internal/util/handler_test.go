@@ -0,0 +1,283 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteStatusError(t *testing.T) {
+	type testCase struct {
+		err        StatusError
+		statusCode int
+		message    string
+		code       string
+	}
+
+	err := errors.New("bad thing")
+	cases := []testCase{
+		{NewBadRequestError(err), http.StatusBadRequest, "bad thing", "bad_request"},
+		{NewInternalServerError(err), http.StatusInternalServerError, "internal server error", "internal_error"},
+		{NewMethodNotAllowedError("PUT", "GET", "POST"), http.StatusMethodNotAllowed, "unsupported method: PUT", "method_not_allowed"},
+		{NewConflictError(err), http.StatusConflict, "bad thing", "conflict"},
+		{NewUnauthorizedError(err), http.StatusUnauthorized, "bad thing", "unauthorized"},
+		{NewForbiddenError(err), http.StatusForbidden, "bad thing", "forbidden"},
+		{NewUnsupportedMediaTypeError("text/plain"), http.StatusUnsupportedMediaType, `unsupported content type: "text/plain"`, "unsupported_media_type"},
+		{NewTooManyRequestsError(err, time.Second), http.StatusTooManyRequests, "bad thing", "rate_limited"},
+		{NewServiceUnavailableError(err, time.Second), http.StatusServiceUnavailable, "service temporarily unavailable", "unavailable"},
+		{notFoundError, http.StatusBadRequest, "not found", "not_found"},
+		{originNotAllowedError, http.StatusForbidden, "origin not allowed", "origin_not_allowed"},
+		{expectationFailedError, http.StatusExpectationFailed, `unsupported expectation; only "100-continue" is supported`, "expectation_failed"},
+		{unsupportedEncodingError, http.StatusUnsupportedMediaType, `unsupported content encoding; only "gzip" is supported`, "unsupported_media_type"},
+		{bodyTooLargeError, http.StatusRequestEntityTooLarge, "decompressed request body exceeds 1048576 bytes", "payload_too_large"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/challenge", nil)
+		w := httptest.NewRecorder()
+		writeStatusError(w, r, "id", c.err)
+
+		assert.Equal(t, c.statusCode, w.Code)
+		assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+		var body struct {
+			Message string `json:"message"`
+			Code    string `json:"code"`
+		}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&body))
+		assert.Equal(t, c.message, body.Message)
+		assert.Equal(t, c.code, body.Code)
+	}
+}
+
+// newTestHTTPRequest constructs a request which will pass the HTTPS check in
+// MakeHTTPHandler.
+func newTestHTTPRequest(method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	return r
+}
+
+// serveTestHTTP serves r using a handler produced by MakeHTTPHandler(handler).
+// It configures the Firestore client to use an emulator so that credentials are
+// not required, so handler must not perform any Firestore operations.
+func serveTestHTTP(handler Handler, r *http.Request) *httptest.ResponseRecorder {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8081")
+		defer os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+	}
+
+	w := httptest.NewRecorder()
+	MakeHTTPHandler(handler)(w, r)
+	return w
+}
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l *Logger) { DefaultLogger = l }(DefaultLogger)
+	DefaultLogger = NewLogger(&buf)
+
+	var id string
+	handler := func(ctx *Context) StatusError {
+		id = ctx.RequestID()
+		return NewBadRequestError(errors.New("bad thing"))
+	}
+
+	// A valid client-supplied ID is echoed and logged.
+	r := newTestHTTPRequest("GET", "/challenge")
+	r.Header.Set("X-Request-Id", "client-id.123")
+	w := serveTestHTTP(handler, r)
+	assert.Equal(t, "client-id.123", id)
+	assert.Equal(t, "client-id.123", w.Header().Get("X-Request-Id"))
+	assert.Contains(t, buf.String(), "client-id.123")
+
+	// Otherwise, a random ID is generated.
+	for _, h := range []string{"", "evil\nid", string(make([]byte, 129))} {
+		buf.Reset()
+		r := newTestHTTPRequest("GET", "/challenge")
+		if h != "" {
+			r.Header.Set("X-Request-Id", h)
+		}
+		w := serveTestHTTP(handler, r)
+		assert.Len(t, id, 32)
+		assert.Equal(t, id, w.Header().Get("X-Request-Id"))
+		assert.Contains(t, buf.String(), id)
+	}
+
+	// Requests rejected before a Context is constructed still get an ID.
+	buf.Reset()
+	r = httptest.NewRequest("GET", "/challenge", nil)
+	r.Header.Set("X-Request-Id", "insecure")
+	w = serveTestHTTP(handler, r)
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Equal(t, "insecure", w.Header().Get("X-Request-Id"))
+	assert.Contains(t, buf.String(), "insecure")
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	defer os.Unsetenv("SECURITY_HEADERS")
+	defer os.Unsetenv("CONTENT_SECURITY_POLICY")
+
+	ok := func(ctx *Context) StatusError { return nil }
+	fail := func(ctx *Context) StatusError { return NewBadRequestError(errors.New("bad thing")) }
+
+	for _, handler := range []Handler{ok, fail} {
+		w := serveTestHTTP(handler, newTestHTTPRequest("GET", "/challenge"))
+		assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+		assert.Equal(t, "DENY", w.Header().Get("X-Frame-Options"))
+		assert.Equal(t, defaultCSP, w.Header().Get("Content-Security-Policy"))
+	}
+
+	os.Setenv("CONTENT_SECURITY_POLICY", "default-src 'self'")
+	w := serveTestHTTP(ok, newTestHTTPRequest("GET", "/challenge"))
+	assert.Equal(t, "default-src 'self'", w.Header().Get("Content-Security-Policy"))
+
+	os.Setenv("SECURITY_HEADERS", "false")
+	w = serveTestHTTP(ok, newTestHTTPRequest("GET", "/challenge"))
+	for _, h := range []string{"X-Frame-Options", "Content-Security-Policy"} {
+		assert.Empty(t, w.Header().Get(h))
+	}
+	// HSTS and nosniff are unaffected.
+	assert.NotEmpty(t, w.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+}
+
+func TestNoSniff(t *testing.T) {
+	os.Setenv("SECURITY_HEADERS", "false")
+	defer os.Unsetenv("SECURITY_HEADERS")
+
+	ok := func(ctx *Context) StatusError { return nil }
+	fail := func(ctx *Context) StatusError { return NewBadRequestError(errors.New("bad thing")) }
+
+	for _, handler := range []Handler{ok, fail} {
+		w := serveTestHTTP(handler, newTestHTTPRequest("GET", "/challenge"))
+		assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	}
+}
+
+// recordingReader is an io.Reader which records whether it has been read from.
+type recordingReader struct {
+	read bool
+	r    io.Reader
+}
+
+func (r *recordingReader) Read(b []byte) (int, error) {
+	r.read = true
+	return r.r.Read(b)
+}
+
+func TestExpectContinue(t *testing.T) {
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8081")
+	defer os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+
+	handler := func(ctx *Context) StatusError {
+		if err := ValidateRequestMethod(ctx, "POST", ""); err != nil {
+			return err
+		}
+		if err := ValidateContentType(ctx, "application/json"); err != nil {
+			return err
+		}
+		_, err := ioutil.ReadAll(ctx.HTTPRequest().Body)
+		assert.Nil(t, err)
+		return nil
+	}
+	server := httptest.NewServer(http.HandlerFunc(MakeHTTPHandler(handler)))
+	defer server.Close()
+
+	// Use a long timeout so that the client only sends the body if the server
+	// responds with "100 Continue".
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Minute}}
+
+	type testCase struct {
+		method      string
+		proto       string
+		contentType string
+		statusCode  int
+		bodySent    bool
+	}
+
+	cases := []testCase{
+		{"POST", "https", "application/json", http.StatusOK, true},
+		{"POST", "http", "application/json", http.StatusTeapot, false},
+		{"PUT", "https", "application/json", http.StatusMethodNotAllowed, false},
+		{"POST", "https", "text/plain", http.StatusUnsupportedMediaType, false},
+	}
+
+	for _, c := range cases {
+		body := &recordingReader{r: strings.NewReader(`{"foo":"bar"}`)}
+		req, err := http.NewRequest(c.method, server.URL, body)
+		assert.Nil(t, err)
+		req.ContentLength = 13
+		req.Header.Set("Expect", "100-continue")
+		req.Header.Set("X-Forwarded-Proto", c.proto)
+		req.Header.Set("Content-Type", c.contentType)
+
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, c.statusCode, resp.StatusCode)
+		assert.Equal(t, c.bodySent, body.read)
+	}
+}
+
+func TestCheckExpect(t *testing.T) {
+	for _, e := range []string{"", "100-continue", "100-Continue"} {
+		r := newTestHTTPRequest("POST", "/report")
+		r.Header.Set("Expect", e)
+		assert.Nil(t, checkExpect(r))
+	}
+
+	r := newTestHTTPRequest("POST", "/report")
+	r.Header.Set("Expect", "something-else")
+	w := serveTestHTTP(func(ctx *Context) StatusError { return nil }, r)
+	assert.Equal(t, http.StatusExpectationFailed, w.Code)
+}
+
+func TestHSTS(t *testing.T) {
+	vars := []string{"HSTS", "HSTS_MAX_AGE", "HSTS_INCLUDE_SUBDOMAINS", "HSTS_PRELOAD"}
+	for _, v := range vars {
+		defer os.Unsetenv(v)
+	}
+
+	type testCase struct {
+		env    map[string]string
+		header string
+	}
+
+	cases := []testCase{
+		{nil, "max-age=63072000; includeSubDomains; preload"},
+		{map[string]string{"HSTS": "true"}, "max-age=63072000; includeSubDomains; preload"},
+		{map[string]string{"HSTS_MAX_AGE": "31536000", "HSTS_PRELOAD": "false"}, "max-age=31536000; includeSubDomains"},
+		{map[string]string{"HSTS_INCLUDE_SUBDOMAINS": "false", "HSTS_PRELOAD": "false"}, "max-age=63072000"},
+		{map[string]string{"HSTS_MAX_AGE": "bogus", "HSTS_PRELOAD": "bogus"}, "max-age=63072000; includeSubDomains; preload"},
+		{map[string]string{"HSTS": "false"}, ""},
+	}
+
+	for _, c := range cases {
+		for _, v := range vars {
+			os.Setenv(v, c.env[v])
+		}
+		w := serveTestHTTP(func(ctx *Context) StatusError { return nil }, newTestHTTPRequest("GET", "/challenge"))
+		assert.Equal(t, c.header, w.Header().Get("Strict-Transport-Security"))
+		_, ok := w.Header()["Strict-Transport-Security"]
+		assert.Equal(t, c.header != "", ok)
+	}
+}
+
+func TestRequestIDRandReader(t *testing.T) {
+	defer func(r io.Reader) { RandReader = r }(RandReader)
+	RandReader = bytes.NewReader(bytes.Repeat([]byte{0xab}, 16))
+
+	w := serveTestHTTP(func(ctx *Context) StatusError { return nil }, newTestHTTPRequest("GET", "/challenge"))
+	assert.Equal(t, strings.Repeat("ab", 16), w.Header().Get("X-Request-Id"))
+}
@@ -0,0 +1,105 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Log entries are written as JSON lines in the structured format understood by
+// Cloud Logging [1], so that they can be filtered by severity and queried by
+// field (e.g., by request ID).
+//
+// [1] https://cloud.google.com/logging/docs/structured-logging
+
+// Severity is the severity of a log entry, using Cloud Logging's names.
+type Severity string
+
+const (
+	SeverityInfo    Severity = "INFO"
+	SeverityWarning Severity = "WARNING"
+	SeverityError   Severity = "ERROR"
+)
+
+// Fields are structured fields attached to a log entry.
+type Fields map[string]interface{}
+
+// Logger writes structured log entries. It is safe for concurrent use.
+type Logger struct {
+	// Shared by all Loggers derived from the same NewLogger call so that
+	// entries are never interleaved.
+	mu     *sync.Mutex
+	w      io.Writer
+	fields Fields
+}
+
+// NewLogger constructs a new *Logger which writes entries to w.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{mu: new(sync.Mutex), w: w}
+}
+
+// DefaultLogger is the *Logger used when no more specific one is available,
+// and from which the Logger of each request's Context is derived. Tests may
+// replace it in order to capture output.
+var DefaultLogger = NewLogger(os.Stderr)
+
+// With returns a *Logger which adds the given fields to every entry, in
+// addition to those added by l.
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{mu: l.mu, w: l.w, fields: merged}
+}
+
+// Log writes an entry with the given severity, extra fields (which may be
+// nil), and message.
+func (l *Logger) Log(severity Severity, fields Fields, format string, args ...interface{}) {
+	entry := make(Fields, len(l.fields)+len(fields)+3)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["severity"] = severity
+	entry["message"] = fmt.Sprintf(format, args...)
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		// A field couldn't be encoded. Fall back to just the message so that
+		// the entry isn't lost.
+		b, _ = json.Marshal(Fields{
+			"severity": severity,
+			"message":  fmt.Sprintf("%v (could not encode log fields: %v)", entry["message"], err),
+			"time":     entry["time"],
+		})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(b, '\n'))
+}
+
+// Infof writes an entry with SeverityInfo.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.Log(SeverityInfo, nil, format, args...)
+}
+
+// Warningf writes an entry with SeverityWarning.
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.Log(SeverityWarning, nil, format, args...)
+}
+
+// Errorf writes an entry with SeverityError.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.Log(SeverityError, nil, format, args...)
+}
@@ -0,0 +1,102 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// decodeLogEntries decodes the JSON lines written to buf.
+func decodeLogEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &entry), line)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf).With(Fields{"a": "b"})
+	l.With(Fields{"c": 1}).Warningf("hello %v", "world")
+	l.Log(SeverityInfo, Fields{"a": "override"}, "plain")
+
+	entries := decodeLogEntries(t, &buf)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "WARNING", entries[0]["severity"])
+	assert.Equal(t, "hello world", entries[0]["message"])
+	assert.Equal(t, "b", entries[0]["a"])
+	assert.Equal(t, float64(1), entries[0]["c"])
+	assert.NotEmpty(t, entries[0]["time"])
+	assert.Equal(t, "INFO", entries[1]["severity"])
+	assert.Equal(t, "override", entries[1]["a"])
+	assert.NotContains(t, entries[1], "c")
+
+	// Fields which can't be encoded don't cause the entry to be lost.
+	buf.Reset()
+	l.Log(SeverityError, Fields{"bad": func() {}}, "oops")
+	entries = decodeLogEntries(t, &buf)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "ERROR", entries[0]["severity"])
+	assert.Contains(t, entries[0]["message"], "oops")
+}
+
+func TestErrorLogging(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l *Logger) { DefaultLogger = l }(DefaultLogger)
+	DefaultLogger = NewLogger(&buf)
+
+	type testCase struct {
+		err      StatusError
+		severity string
+	}
+
+	cases := []testCase{
+		{NewBadRequestError(errors.New("bad thing")), "WARNING"},
+		{NewInternalServerError(errors.New("secret")), "ERROR"},
+	}
+
+	for _, c := range cases {
+		buf.Reset()
+		r := newTestHTTPRequest("GET", "/challenge")
+		r.Header.Set("X-Request-Id", "the-id")
+		serveTestHTTP(func(ctx *Context) StatusError { return c.err }, r)
+
+		entries := decodeLogEntries(t, &buf)
+		assert.Len(t, entries, 1)
+		entry := entries[0]
+		assert.Equal(t, c.severity, entry["severity"])
+		assert.Equal(t, "the-id", entry["request_id"])
+		assert.Equal(t, "/challenge", entry["endpoint"])
+		assert.Equal(t, float64(c.err.HTTPStatusCode()), entry["status"])
+		assert.Equal(t, c.err.Code(), entry["code"])
+		assert.Equal(t, c.err.Error(), entry["error"])
+		assert.Contains(t, entry["message"], c.err.Message())
+	}
+
+	// Handlers can log using the Context's Logger, which includes the request
+	// ID.
+	buf.Reset()
+	r := newTestHTTPRequest("GET", "/challenge")
+	r.Header.Set("X-Request-Id", "the-id")
+	w := serveTestHTTP(func(ctx *Context) StatusError {
+		ctx.Logger().Infof("handled")
+		return nil
+	}, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	entries := decodeLogEntries(t, &buf)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "INFO", entries[0]["severity"])
+	assert.Equal(t, "the-id", entries[0]["request_id"])
+	assert.Equal(t, "handled", entries[0]["message"])
+
+	// Contexts not constructed by MakeHTTPHandler use DefaultLogger.
+	assert.Equal(t, DefaultLogger, (&Context{}).Logger())
+}
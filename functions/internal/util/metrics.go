@@ -0,0 +1,266 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Handlers produced by MakeHTTPHandler record a count of requests by endpoint
+// and status code, and a histogram of request latencies by endpoint, in
+// DefaultMetrics. The pow package additionally records the outcome of each
+// proof-of-work validation, and a histogram of solution verification times by
+// work factor, so that the work factor can be tuned. Metrics are kept in memory and exposed in the Prometheus text
+// exposition format [1] by (*Metrics).ServeHTTP.
+//
+// [1] https://prometheus.io/docs/instrumenting/exposition_formats/
+
+// The upper bounds, in seconds, of the latency histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+const (
+	// The maximum number of distinct endpoints which are tracked. Requests to
+	// other endpoints are recorded under otherEndpoint so that clients can't
+	// exhaust memory by requesting arbitrary paths.
+	maxMetricsEndpoints = 32
+	otherEndpoint       = "other"
+)
+
+type requestKey struct {
+	endpoint string
+	code     int
+}
+
+type histogram struct {
+	// counts[i] is the number of observations in bucket i (not cumulative).
+	// The final element counts observations above the largest bound.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *histogram) observe(latency time.Duration) {
+	secs := latency.Seconds()
+	h.counts[sort.SearchFloat64s(latencyBuckets, secs)]++
+	h.sum += secs
+	h.count++
+}
+
+// writeHistogram writes h as the histogram metric name with the given label
+// (of the form `key="value"`).
+func writeHistogram(b *strings.Builder, name, label string, h *histogram) {
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"%s\"} %d\n",
+			name, label, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, label, h.count)
+	fmt.Fprintf(b, "%s_sum{%s} %s\n", name, label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count{%s} %d\n", name, label, h.count)
+}
+
+// Metrics collects request metrics. It is safe for concurrent use.
+type Metrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	latencies map[string]*histogram
+	// Proof-of-work validation outcomes, and verification times by work
+	// factor.
+	powValidations     map[bool]uint64
+	powVerifyLatencies map[uint64]*histogram
+}
+
+// NewMetrics constructs a new, empty *Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:           make(map[requestKey]uint64),
+		latencies:          make(map[string]*histogram),
+		powValidations:     make(map[bool]uint64),
+		powVerifyLatencies: make(map[uint64]*histogram),
+	}
+}
+
+// DefaultMetrics is the *Metrics in which handlers produced by MakeHTTPHandler
+// record requests. Tests may replace it.
+var DefaultMetrics = NewMetrics()
+
+// observe records a request to endpoint which completed with the given status
+// code after latency.
+func (m *Metrics) observe(endpoint string, code int, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.latencies[endpoint]
+	if !ok {
+		if len(m.latencies) >= maxMetricsEndpoints {
+			endpoint = otherEndpoint
+			h = m.latencies[endpoint]
+		}
+		if h == nil {
+			h = newHistogram()
+			m.latencies[endpoint] = h
+		}
+	}
+	m.requests[requestKey{endpoint, code}]++
+	h.observe(latency)
+}
+
+// ObservePoWValidation records the outcome of validating a proof-of-work
+// solution.
+func (m *Metrics) ObservePoWValidation(ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.powValidations[ok]++
+}
+
+// ObservePoWVerification records that verifying a proof-of-work solution to a
+// challenge with the given work factor took latency. Verifications are tracked
+// separately for each work factor, so callers must only record challenges
+// which they issued, lest clients inflate the number of work factors tracked.
+func (m *Metrics) ObservePoWVerification(workFactor uint64, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.powVerifyLatencies[workFactor]
+	if !ok {
+		h = newHistogram()
+		m.powVerifyLatencies[workFactor] = h
+	}
+	h.observe(latency)
+}
+
+// PoWValidationCount returns the number of proof-of-work validations recorded
+// with the given outcome.
+func (m *Metrics) PoWValidationCount(ok bool) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.powValidations[ok]
+}
+
+// PoWVerificationCount returns the number of proof-of-work verifications
+// recorded for challenges with the given work factor.
+func (m *Metrics) PoWVerificationCount(workFactor uint64) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok := m.powVerifyLatencies[workFactor]; ok {
+		return h.count
+	}
+	return 0
+}
+
+// RequestCount returns the number of requests recorded for endpoint which
+// completed with the given status code.
+func (m *Metrics) RequestCount(endpoint string, code int) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requests[requestKey{endpoint, code}]
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteTo writes m to w in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP http_requests_total Total number of HTTP requests by endpoint and status code.\n")
+	b.WriteString("# TYPE http_requests_total counter\n")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, k := range keys {
+		fmt.Fprintf(&b, "http_requests_total{endpoint=\"%s\",code=\"%d\"} %d\n",
+			labelEscaper.Replace(k.endpoint), k.code, m.requests[k])
+	}
+
+	b.WriteString("# HELP http_request_duration_seconds HTTP request latencies by endpoint.\n")
+	b.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	endpoints := make([]string, 0, len(m.latencies))
+	for e := range m.latencies {
+		endpoints = append(endpoints, e)
+	}
+	sort.Strings(endpoints)
+	for _, e := range endpoints {
+		label := fmt.Sprintf("endpoint=\"%s\"", labelEscaper.Replace(e))
+		writeHistogram(&b, "http_request_duration_seconds", label, m.latencies[e])
+	}
+
+	b.WriteString("# HELP pow_validations_total Total number of proof-of-work validations by result.\n")
+	b.WriteString("# TYPE pow_validations_total counter\n")
+	for _, ok := range []bool{true, false} {
+		result := "failure"
+		if ok {
+			result = "success"
+		}
+		fmt.Fprintf(&b, "pow_validations_total{result=\"%s\"} %d\n", result, m.powValidations[ok])
+	}
+
+	b.WriteString("# HELP pow_verification_duration_seconds Proof-of-work solution verification times by work factor.\n")
+	b.WriteString("# TYPE pow_verification_duration_seconds histogram\n")
+	workFactors := make([]uint64, 0, len(m.powVerifyLatencies))
+	for wf := range m.powVerifyLatencies {
+		workFactors = append(workFactors, wf)
+	}
+	sort.Slice(workFactors, func(i, j int) bool { return workFactors[i] < workFactors[j] })
+	for _, wf := range workFactors {
+		label := fmt.Sprintf("work_factor=\"%d\"", wf)
+		writeHistogram(&b, "pow_verification_duration_seconds", label, m.powVerifyLatencies[wf])
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves m in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	m.WriteTo(w)
+}
+
+// statusRecorder is an http.ResponseWriter which records the status code of
+// the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// status returns the recorded status code, defaulting to http.StatusOK if
+// nothing was written.
+func (s *statusRecorder) status() int {
+	if s.code == 0 {
+		return http.StatusOK
+	}
+	return s.code
+}
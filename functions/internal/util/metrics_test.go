@@ -0,0 +1,114 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	defer func(m *Metrics) { DefaultMetrics = m }(DefaultMetrics)
+	DefaultMetrics = NewMetrics()
+
+	ok := func(ctx *Context) StatusError { return nil }
+	fail := func(ctx *Context) StatusError { return NewBadRequestError(errors.New("bad thing")) }
+
+	for i := 0; i < 3; i++ {
+		serveTestHTTP(ok, newTestHTTPRequest("GET", "/challenge"))
+	}
+	serveTestHTTP(fail, newTestHTTPRequest("GET", "/challenge"))
+	// Rejected before the handler runs.
+	serveTestHTTP(ok, httptest.NewRequest("GET", "/challenge", nil))
+	serveTestHTTP(ok, newTestHTTPRequest("GET", "/health"))
+
+	assert.Equal(t, uint64(3), DefaultMetrics.RequestCount("/challenge", http.StatusOK))
+	assert.Equal(t, uint64(1), DefaultMetrics.RequestCount("/challenge", http.StatusBadRequest))
+	assert.Equal(t, uint64(1), DefaultMetrics.RequestCount("/challenge", http.StatusTeapot))
+	assert.Equal(t, uint64(1), DefaultMetrics.RequestCount("/health", http.StatusOK))
+	assert.Equal(t, uint64(0), DefaultMetrics.RequestCount("/health", http.StatusBadRequest))
+
+	w := httptest.NewRecorder()
+	DefaultMetrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	assert.Contains(t, body, `http_requests_total{endpoint="/challenge",code="200"} 3`)
+	assert.Contains(t, body, `http_requests_total{endpoint="/challenge",code="418"} 1`)
+	assert.Contains(t, body, `http_request_duration_seconds_bucket{endpoint="/challenge",le="+Inf"} 5`)
+	assert.Contains(t, body, `http_request_duration_seconds_count{endpoint="/health"} 1`)
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	m := NewMetrics()
+	m.observe("/challenge", http.StatusOK, 3*time.Millisecond)
+	m.observe("/challenge", http.StatusOK, 30*time.Millisecond)
+	m.observe("/challenge", http.StatusOK, time.Minute)
+
+	var b strings.Builder
+	_, err := m.WriteTo(&b)
+	assert.Nil(t, err)
+	for _, line := range []string{
+		`http_request_duration_seconds_bucket{endpoint="/challenge",le="0.005"} 1`,
+		`http_request_duration_seconds_bucket{endpoint="/challenge",le="0.025"} 1`,
+		`http_request_duration_seconds_bucket{endpoint="/challenge",le="0.05"} 2`,
+		`http_request_duration_seconds_bucket{endpoint="/challenge",le="10"} 2`,
+		`http_request_duration_seconds_bucket{endpoint="/challenge",le="+Inf"} 3`,
+		`http_request_duration_seconds_sum{endpoint="/challenge"} 60.033`,
+		`http_request_duration_seconds_count{endpoint="/challenge"} 3`,
+	} {
+		assert.Contains(t, b.String(), line+"\n")
+	}
+}
+
+func TestMetricsEndpointLimit(t *testing.T) {
+	m := NewMetrics()
+	for i := 0; i < 2*maxMetricsEndpoints; i++ {
+		m.observe(fmt.Sprintf("/%d", i), http.StatusNotFound, time.Millisecond)
+	}
+	assert.Len(t, m.latencies, maxMetricsEndpoints+1)
+	assert.Equal(t, uint64(maxMetricsEndpoints), m.RequestCount(otherEndpoint, http.StatusNotFound))
+
+	// Label values are escaped.
+	m = NewMetrics()
+	m.observe("/\"quoted\"", http.StatusOK, time.Millisecond)
+	var b strings.Builder
+	m.WriteTo(&b)
+	assert.Contains(t, b.String(), `endpoint="/\"quoted\""`)
+}
+
+func TestMetricsPoW(t *testing.T) {
+	m := NewMetrics()
+	m.ObservePoWValidation(true)
+	m.ObservePoWValidation(false)
+	m.ObservePoWValidation(false)
+	m.ObservePoWVerification(1024, 3*time.Millisecond)
+	m.ObservePoWVerification(1024, time.Second)
+	m.ObservePoWVerification(16, time.Millisecond)
+
+	assert.Equal(t, uint64(1), m.PoWValidationCount(true))
+	assert.Equal(t, uint64(2), m.PoWValidationCount(false))
+	assert.Equal(t, uint64(2), m.PoWVerificationCount(1024))
+	assert.Equal(t, uint64(1), m.PoWVerificationCount(16))
+	assert.Equal(t, uint64(0), m.PoWVerificationCount(2))
+
+	var b strings.Builder
+	_, err := m.WriteTo(&b)
+	assert.Nil(t, err)
+	for _, line := range []string{
+		`pow_validations_total{result="success"} 1`,
+		`pow_validations_total{result="failure"} 2`,
+		`pow_verification_duration_seconds_bucket{work_factor="16",le="0.005"} 1`,
+		`pow_verification_duration_seconds_bucket{work_factor="1024",le="0.005"} 1`,
+		`pow_verification_duration_seconds_bucket{work_factor="1024",le="+Inf"} 2`,
+		`pow_verification_duration_seconds_sum{work_factor="1024"} 1.003`,
+		`pow_verification_duration_seconds_count{work_factor="1024"} 2`,
+	} {
+		assert.Contains(t, b.String(), line+"\n")
+	}
+	// Work factors are sorted numerically.
+	assert.True(t, strings.Index(b.String(), `work_factor="16"`) < strings.Index(b.String(), `work_factor="1024"`))
+}
@@ -0,0 +1,175 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Rate limiting is implemented using a token bucket per client IP address.
+// Each bucket holds at most RATE_LIMIT_BURST tokens, and is refilled at a rate
+// of RATE_LIMIT_PER_MINUTE tokens per minute. Each request consumes one token,
+// and requests which arrive when the bucket is empty are rejected. Buckets are
+// stored in Firestore so that limits are enforced across all function
+// instances. If RATE_LIMIT_PER_MINUTE is unset, rate limiting is disabled.
+
+const (
+	// The name of the Firestore collection of rate limit buckets.
+	rateLimitCollection = "rate_limits"
+
+	defaultRateLimitBurst = 10
+)
+
+var rateLimitedError = errors.New("too many requests")
+
+type rateLimitConfig struct {
+	// The number of tokens added to each bucket per minute. If it is not
+	// positive, rate limiting is disabled.
+	perMinute float64
+	// The maximum number of tokens in each bucket.
+	burst float64
+}
+
+// getRateLimitConfig reads the rate limit configuration from the
+// RATE_LIMIT_PER_MINUTE and RATE_LIMIT_BURST environment variables. Invalid
+// values are logged and ignored.
+func getRateLimitConfig() rateLimitConfig {
+	cfg := rateLimitConfig{burst: defaultRateLimitBurst}
+	if s := os.Getenv("RATE_LIMIT_PER_MINUTE"); s != "" {
+		r, err := strconv.ParseFloat(s, 64)
+		if err != nil || r <= 0 {
+			DefaultLogger.Warningf("ignoring invalid RATE_LIMIT_PER_MINUTE %q", s)
+		} else {
+			cfg.perMinute = r
+		}
+	}
+	if s := os.Getenv("RATE_LIMIT_BURST"); s != "" {
+		b, err := strconv.ParseUint(s, 10, 32)
+		if err != nil || b < 1 {
+			DefaultLogger.Warningf("ignoring invalid RATE_LIMIT_BURST %q", s)
+		} else {
+			cfg.burst = float64(b)
+		}
+	}
+	return cfg
+}
+
+// The document stored in Firebase for a given client's token bucket. Its ID is
+// the client's IP address.
+type rateLimitDoc struct {
+	// The number of tokens in the bucket as of Updated.
+	Tokens  float64
+	Updated time.Time
+	// The time at which the bucket will be full again, after which this
+	// document is no longer needed.
+	Expiration time.Time
+}
+
+// take attempts to take a token from the bucket described by doc at time now.
+// If a token is available, it returns the updated bucket and true. Otherwise,
+// it returns how long the client must wait until a token will be available and
+// false.
+func (doc rateLimitDoc) take(now time.Time, cfg rateLimitConfig) (rateLimitDoc, time.Duration, bool) {
+	tokens := cfg.burst
+	if !doc.Updated.IsZero() {
+		elapsed := now.Sub(doc.Updated)
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		tokens = doc.Tokens + elapsed.Minutes()*cfg.perMinute
+		if tokens > cfg.burst {
+			tokens = cfg.burst
+		}
+	}
+
+	if tokens < 1 {
+		wait := time.Duration((1 - tokens) / cfg.perMinute * float64(time.Minute))
+		return doc, wait, false
+	}
+
+	tokens--
+	refill := time.Duration((cfg.burst - tokens) / cfg.perMinute * float64(time.Minute))
+	return rateLimitDoc{Tokens: tokens, Updated: now, Expiration: now.Add(refill)}, 0, true
+}
+
+// RateLimit wraps handler, producing a Handler which rejects requests with a
+// StatusError whose HTTPStatusCode method returns http.StatusTooManyRequests
+// if the client has exceeded its rate limit. See the documentation at the top
+// of this file for how limits are configured.
+//
+// Since taking a token costs a Firestore transaction, RateLimit should be
+// wrapped by any cheap validation (such as ValidateRequestMethod), so that
+// requests which would be rejected anyway neither load the database nor
+// consume the client's quota.
+func RateLimit(handler Handler) Handler {
+	return func(ctx *Context) StatusError {
+		cfg := getRateLimitConfig()
+		if cfg.perMinute > 0 {
+			if err := takeRateLimitToken(ctx, ctx.ClientIP(), ctx.Now(), cfg); err != nil {
+				return err
+			}
+		}
+		return handler(ctx)
+	}
+}
+
+// updateRateLimitBucket atomically applies update to the bucket for the given
+// client, storing the result if update returns true. A client with no stored
+// bucket has the zero rateLimitDoc. It is a variable so that tests can replace
+// it.
+var updateRateLimitBucket = func(ctx *Context, client string, update func(rateLimitDoc) (rateLimitDoc, bool)) StatusError {
+	ref := ctx.FirestoreClient().Collection(rateLimitCollection).Doc(client)
+	return RunTransaction(ctx, func(_ context.Context, tx *firestore.Transaction) error {
+		var doc rateLimitDoc
+		snapshot, err := tx.Get(ref)
+		switch {
+		case status.Code(err) == codes.NotFound:
+			// This client has no bucket yet; leave doc as the zero value.
+		case err != nil:
+			return err
+		default:
+			if err := snapshot.DataTo(&doc); err != nil {
+				return err
+			}
+		}
+
+		doc, ok := update(doc)
+		if !ok {
+			return nil
+		}
+		return tx.Set(ref, doc)
+	})
+}
+
+// takeRateLimitToken atomically takes a token from the bucket for the given
+// client, returning an appropriate StatusError if none is available.
+func takeRateLimitToken(ctx *Context, client string, now time.Time, cfg rateLimitConfig) StatusError {
+	var (
+		limited bool
+		wait    time.Duration
+	)
+	err := updateRateLimitBucket(ctx, client, func(doc rateLimitDoc) (rateLimitDoc, bool) {
+		// The transaction may be retried, so reset any state from a previous
+		// attempt.
+		limited = false
+
+		doc, w, ok := doc.take(now, cfg)
+		if !ok {
+			limited, wait = true, w
+		}
+		return doc, ok
+	})
+	if err != nil {
+		return err
+	}
+	if limited {
+		return NewTooManyRequestsError(rateLimitedError, wait)
+	}
+	return nil
+}
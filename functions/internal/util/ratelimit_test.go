@@ -0,0 +1,132 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitTake(t *testing.T) {
+	cfg := rateLimitConfig{perMinute: 60, burst: 3}
+	now := time.Now()
+
+	// A new client starts with a full bucket.
+	var doc rateLimitDoc
+	for i := 0; i < 3; i++ {
+		var ok bool
+		doc, _, ok = doc.take(now, cfg)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, now.Add(3*time.Second), doc.Expiration)
+
+	// The bucket is now empty.
+	_, wait, ok := doc.take(now, cfg)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+	_, wait, ok = doc.take(now.Add(500*time.Millisecond), cfg)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// After one second, one token has been added.
+	doc, _, ok = doc.take(now.Add(time.Second), cfg)
+	assert.True(t, ok)
+	_, _, ok = doc.take(now.Add(time.Second), cfg)
+	assert.False(t, ok)
+
+	// The bucket never holds more than burst tokens.
+	doc, _, ok = doc.take(now.Add(time.Hour), cfg)
+	assert.True(t, ok)
+	assert.Equal(t, float64(2), doc.Tokens)
+}
+
+func TestTooManyRequestsError(t *testing.T) {
+	type testCase struct {
+		retryAfter time.Duration
+		header     string
+	}
+
+	cases := []testCase{
+		{0, "1"},
+		{time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{time.Minute, "60"},
+	}
+
+	for _, c := range cases {
+		err := NewTooManyRequestsError(rateLimitedError, c.retryAfter)
+		assert.Equal(t, http.StatusTooManyRequests, err.HTTPStatusCode())
+		assert.Equal(t, CodeRateLimited, err.Code())
+
+		r := httptest.NewRequest("GET", "/challenge", nil)
+		w := httptest.NewRecorder()
+		writeStatusError(w, r, "id", err)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, c.header, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestGetRateLimitConfig(t *testing.T) {
+	defer os.Unsetenv("RATE_LIMIT_PER_MINUTE")
+	defer os.Unsetenv("RATE_LIMIT_BURST")
+
+	assert.Equal(t, rateLimitConfig{burst: defaultRateLimitBurst}, getRateLimitConfig())
+
+	os.Setenv("RATE_LIMIT_PER_MINUTE", "30")
+	os.Setenv("RATE_LIMIT_BURST", "5")
+	assert.Equal(t, rateLimitConfig{perMinute: 30, burst: 5}, getRateLimitConfig())
+
+	os.Setenv("RATE_LIMIT_PER_MINUTE", "-1")
+	os.Setenv("RATE_LIMIT_BURST", "0")
+	assert.Equal(t, rateLimitConfig{burst: defaultRateLimitBurst}, getRateLimitConfig())
+}
+
+func TestRateLimit(t *testing.T) {
+	defer func(f func(*Context, string, func(rateLimitDoc) (rateLimitDoc, bool)) StatusError) {
+		updateRateLimitBucket = f
+	}(updateRateLimitBucket)
+	defer os.Unsetenv("RATE_LIMIT_PER_MINUTE")
+	defer os.Unsetenv("RATE_LIMIT_BURST")
+	os.Setenv("RATE_LIMIT_PER_MINUTE", "60")
+	os.Setenv("RATE_LIMIT_BURST", "2")
+
+	// Buckets are faked using a map of documents by client.
+	buckets := make(map[string]rateLimitDoc)
+	updateRateLimitBucket = func(ctx *Context, client string, update func(rateLimitDoc) (rateLimitDoc, bool)) StatusError {
+		if doc, ok := update(buckets[client]); ok {
+			buckets[client] = doc
+		}
+		return nil
+	}
+
+	calls := 0
+	handler := RateLimit(func(ctx *Context) StatusError {
+		calls++
+		return nil
+	})
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := newTestHTTPRequest("GET", "/challenge")
+		r.RemoteAddr = remoteAddr
+		return serveTestHTTP(handler, r)
+	}
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusOK, request("192.0.2.1:1234").Code)
+	}
+	assert.Equal(t, 2, calls)
+
+	// The burst has been used up.
+	w := request("192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), CodeRateLimited)
+	assert.Equal(t, 2, calls)
+
+	// Other clients have their own buckets.
+	assert.Equal(t, http.StatusOK, request("192.0.2.2:1234").Code)
+	assert.Equal(t, 3, calls)
+}
@@ -0,0 +1,103 @@
+package util
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+)
+
+// Requests are traced using spans. MakeHTTPHandler starts a span for each
+// request, continuing the trace from the W3C traceparent header [1] if one is
+// present, and operations such as Firestore transactions start child spans.
+// Spans are created by DefaultTracer, which does nothing unless it is replaced
+// (e.g., with an adapter for a tracing library which exports spans).
+//
+// [1] https://www.w3.org/TR/trace-context/#traceparent-header
+
+// A Span represents a single traced operation.
+type Span interface {
+	// SetAttribute records an attribute of the operation.
+	SetAttribute(key string, value interface{})
+	// End marks the operation as complete.
+	End()
+}
+
+// A Tracer creates Spans.
+type Tracer interface {
+	// Start starts a span with the given name, returning a context which
+	// carries it. The span is a child of the span carried by ctx, if any, or
+	// else continues the trace from RemoteSpanContext(ctx), if any.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) End()                                       {}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+// DefaultTracer is the Tracer used to trace requests. By default, it does
+// nothing.
+var DefaultTracer Tracer = noopTracer{}
+
+// StartSpan starts a span using DefaultTracer. See Tracer.Start.
+func StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	return DefaultTracer.Start(ctx, name)
+}
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+type remoteSpanContextKey struct{}
+
+// RemoteSpanContext returns the SpanContext of the remote parent of the
+// request whose context is ctx, as given by its traceparent header.
+func RemoteSpanContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(remoteSpanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+func withRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteSpanContextKey{}, sc)
+}
+
+// parseTraceparent parses the value of a traceparent header. Unknown future
+// versions are parsed according to the version 00 format, as the
+// specification requires.
+func parseTraceparent(s string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		(parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+	var flags [1]byte
+	for _, f := range []struct {
+		s   string
+		dst []byte
+	}{{parts[0], make([]byte, 1)}, {parts[1], sc.TraceID[:]}, {parts[2], sc.SpanID[:]}, {parts[3], flags[:]}} {
+		if len(f.s) != 2*len(f.dst) || strings.ToLower(f.s) != f.s {
+			return SpanContext{}, false
+		}
+		if _, err := hex.Decode(f.dst, []byte(f.s)); err != nil {
+			return SpanContext{}, false
+		}
+	}
+
+	// All-zero trace and span IDs are invalid.
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
@@ -0,0 +1,148 @@
+package util
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingTracer is a Tracer which records spans in memory.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name    string
+	traceID [16]byte
+	// The parent span, if it is local.
+	parent *recordedSpan
+	// The parent span, if it is remote.
+	remote *SpanContext
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *recordedSpan) End()                                       { s.ended = true }
+
+type recordedSpanKey struct{}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	s := &recordedSpan{name: name, attrs: make(map[string]interface{})}
+	if p, ok := ctx.Value(recordedSpanKey{}).(*recordedSpan); ok {
+		s.parent, s.traceID = p, p.traceID
+	} else if sc, ok := RemoteSpanContext(ctx); ok {
+		s.remote, s.traceID = &sc, sc.TraceID
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, s)
+	return context.WithValue(ctx, recordedSpanKey{}, s), s
+}
+
+func TestTracing(t *testing.T) {
+	defer func(tr Tracer) { DefaultTracer = tr }(DefaultTracer)
+	tracer := &recordingTracer{}
+	DefaultTracer = tracer
+
+	handler := func(ctx *Context) StatusError {
+		_, span := StartSpan(ctx, "child")
+		span.End()
+		return NewBadRequestError(errors.New("bad thing"))
+	}
+
+	r := newTestHTTPRequest("GET", "/challenge")
+	r.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	serveTestHTTP(handler, r)
+
+	assert.Len(t, tracer.spans, 2)
+	req, child := tracer.spans[0], tracer.spans[1]
+	assert.Equal(t, "/challenge", req.name)
+	assert.True(t, req.ended)
+	assert.NotNil(t, req.remote)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", hex.EncodeToString(req.traceID[:]))
+	assert.Equal(t, "/challenge", req.attrs["endpoint"])
+	assert.Equal(t, http.StatusBadRequest, req.attrs["status_code"])
+	assert.NotEmpty(t, req.attrs["request_id"])
+
+	assert.Equal(t, "child", child.name)
+	assert.True(t, child.ended)
+	assert.Equal(t, req, child.parent)
+	assert.Equal(t, req.traceID, child.traceID)
+
+	// Spans started by operations such as RunTransaction are children of the
+	// request span, and spans started within them are their children.
+	defer func(f func(context.Context, *firestore.Client, func(context.Context, *firestore.Transaction) error, ...firestore.TransactionOption) error) {
+		runFirestoreTransaction = f
+	}(runFirestoreTransaction)
+	runFirestoreTransaction = func(ctx context.Context, client *firestore.Client, f func(context.Context, *firestore.Transaction) error, opts ...firestore.TransactionOption) error {
+		_, span := StartSpan(ctx, "commit")
+		span.End()
+		return f(ctx, nil)
+	}
+	tracer.spans = nil
+	serveTestHTTP(func(ctx *Context) StatusError {
+		return RunTransaction(ctx, func(ctx context.Context, _ *firestore.Transaction) error {
+			_, span := StartSpan(ctx, "body")
+			span.End()
+			return nil
+		})
+	}, newTestHTTPRequest("GET", "/challenge"))
+
+	if assert.Len(t, tracer.spans, 4) {
+		req, tx, commit, body := tracer.spans[0], tracer.spans[1], tracer.spans[2], tracer.spans[3]
+		assert.Equal(t, "firestore.RunTransaction", tx.name)
+		assert.Equal(t, req, tx.parent)
+		assert.Equal(t, "commit", commit.name)
+		assert.Equal(t, tx, commit.parent)
+		assert.Equal(t, "body", body.name)
+		assert.Equal(t, tx, body.parent)
+		assert.True(t, tx.ended)
+	}
+
+	// Without a traceparent header, each request starts a new trace.
+	tracer.spans = nil
+	serveTestHTTP(handler, newTestHTTPRequest("GET", "/challenge"))
+	serveTestHTTP(handler, newTestHTTPRequest("GET", "/challenge"))
+	assert.Len(t, tracer.spans, 4)
+	assert.Nil(t, tracer.spans[0].remote)
+	assert.Nil(t, tracer.spans[0].parent)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	type testCase struct {
+		header  string
+		ok      bool
+		sampled bool
+	}
+
+	cases := []testCase{
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true, true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", true, false},
+		// Future versions may append fields.
+		{"01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra", true, true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra", false, false},
+		{"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", false, false},
+		{"00-00000000000000000000000000000000-b7ad6b7169203331-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01", false, false},
+		{"00-0AF7651916CD43DD8448EB211C80319C-b7ad6b7169203331-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c8031-b7ad6b7169203331-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c80319z-b7ad6b7169203331-01", false, false},
+		{"", false, false},
+		{"garbage", false, false},
+	}
+
+	for _, c := range cases {
+		sc, ok := parseTraceparent(c.header)
+		assert.Equal(t, c.ok, ok, c.header)
+		assert.Equal(t, c.sampled, sc.Sampled, c.header)
+	}
+}
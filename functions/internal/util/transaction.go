@@ -0,0 +1,151 @@
+package util
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Firestore transactions can fail with Aborted under contention, or with
+// Unavailable when the backend is briefly unreachable. RunTransaction retries
+// such failures with exponential backoff and full jitter, up to
+// FIRESTORE_TRANSACTION_ATTEMPTS attempts in total. Errors returned by the
+// transaction function itself which are StatusErrors are never retried, since
+// they represent business logic failures rather than transient ones. The
+// Firestore client's own retries are disabled, so that this is the only retry
+// policy; otherwise, each of our attempts could itself run the transaction
+// several times.
+
+const (
+	defaultTransactionAttempts = 3
+
+	transactionBaseBackoff = 50 * time.Millisecond
+	transactionMaxBackoff  = time.Second
+)
+
+// transactionAttempts returns the maximum number of times a transaction is
+// attempted. It is read from the FIRESTORE_TRANSACTION_ATTEMPTS environment
+// variable. If the variable is unset, or its value is invalid or not positive,
+// defaultTransactionAttempts is used.
+func transactionAttempts() int {
+	s := os.Getenv("FIRESTORE_TRANSACTION_ATTEMPTS")
+	if s == "" {
+		return defaultTransactionAttempts
+	}
+
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || n < 1 {
+		DefaultLogger.Warningf("ignoring invalid FIRESTORE_TRANSACTION_ATTEMPTS %q", s)
+		return defaultTransactionAttempts
+	}
+	return int(n)
+}
+
+// isRetryableTransactionError returns true if err is a transient Firestore
+// failure which is worth retrying.
+func isRetryableTransactionError(err error) bool {
+	if _, ok := err.(StatusError); ok {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Aborted, codes.Unavailable:
+		return true
+	default:
+		return false
+	}
+}
+
+// transactionBackoff returns how long to wait before the given retry (the first
+// retry is 1). It is chosen uniformly at random from the interval up to an
+// exponentially increasing cap, using rnd (which behaves like
+// rand.Int63n).
+func transactionBackoff(retry int, rnd func(int64) int64) time.Duration {
+	max := transactionMaxBackoff
+	if retry < 32 {
+		if d := transactionBaseBackoff << uint(retry-1); d < max {
+			max = d
+		}
+	}
+	return time.Duration(rnd(int64(max) + 1))
+}
+
+// sleepContext sleeps for d, returning early with ctx.Err() if ctx is done
+// first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryTransaction calls attempt until it succeeds, fails with an error which
+// isn't retryable, or has been called attempts times, sleeping between calls
+// using sleep. It returns the error from the last call.
+func retryTransaction(ctx context.Context, attempts int, sleep func(context.Context, time.Duration) error, attempt func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			if serr := sleep(ctx, transactionBackoff(i, rand.Int63n)); serr != nil {
+				return err
+			}
+		}
+
+		err = attempt()
+		if err == nil || !isRetryableTransactionError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// runFirestoreTransaction runs f in a Firestore transaction using client,
+// passing opts to the client. It is a variable so that tests can replace it.
+var runFirestoreTransaction = func(ctx context.Context, client *firestore.Client, f func(context.Context, *firestore.Transaction) error, opts ...firestore.TransactionOption) error {
+	return client.RunTransaction(ctx, f, opts...)
+}
+
+// RunTransaction runs f in a Firestore transaction using ctx's client, retrying
+// transient failures as described at the top of this file. Each attempt is
+// subject to the timeout described in WithFirestoreTimeout, and its latency is
+// recorded for use by Backpressure. If f returns a StatusError, it is returned
+// unchanged; other errors are converted using FirestoreToStatusError.
+func RunTransaction(ctx *Context, f func(context.Context, *firestore.Transaction) error) StatusError {
+	sctx, span := StartSpan(ctx, "firestore.RunTransaction")
+	defer span.End()
+	ctx = ctx.WithContext(sctx)
+
+	attempts := 0
+	err := retryTransaction(ctx, transactionAttempts(), sleepContext, func() error {
+		attempts++
+		tctx, cancel := ctx.WithFirestoreTimeout()
+		defer cancel()
+		start := time.Now()
+		err := runFirestoreTransaction(tctx, ctx.FirestoreClient(), f, firestore.MaxAttempts(1))
+		RecordFirestoreLatency(start)
+		return err
+	})
+
+	span.SetAttribute("attempts", attempts)
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+	}
+
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case StatusError:
+		return err
+	default:
+		return FirestoreToStatusError(err)
+	}
+}
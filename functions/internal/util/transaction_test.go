@@ -0,0 +1,125 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTransactionAttempts(t *testing.T) {
+	defer os.Unsetenv("FIRESTORE_TRANSACTION_ATTEMPTS")
+
+	for _, env := range []string{"", "bogus", "0", "-1"} {
+		os.Setenv("FIRESTORE_TRANSACTION_ATTEMPTS", env)
+		assert.Equal(t, defaultTransactionAttempts, transactionAttempts())
+	}
+	os.Setenv("FIRESTORE_TRANSACTION_ATTEMPTS", "5")
+	assert.Equal(t, 5, transactionAttempts())
+}
+
+func TestTransactionBackoff(t *testing.T) {
+	// Return the largest possible value so that we can check the cap.
+	max := func(n int64) int64 { return n - 1 }
+	assert.Equal(t, transactionBaseBackoff, transactionBackoff(1, max))
+	assert.Equal(t, 2*transactionBaseBackoff, transactionBackoff(2, max))
+	assert.Equal(t, 4*transactionBaseBackoff, transactionBackoff(3, max))
+	assert.Equal(t, transactionMaxBackoff, transactionBackoff(10, max))
+	assert.Equal(t, transactionMaxBackoff, transactionBackoff(100, max))
+	assert.Equal(t, time.Duration(0), transactionBackoff(1, func(int64) int64 { return 0 }))
+}
+
+func TestRetryTransaction(t *testing.T) {
+	type testCase struct {
+		// The errors returned by successive attempts.
+		errs     []error
+		attempts int
+		err      error
+		calls    int
+	}
+
+	aborted := status.Error(codes.Aborted, "aborted")
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	internal := status.Error(codes.Internal, "internal")
+	conflict := NewConflictError(errors.New("conflict"))
+
+	cases := []testCase{
+		{[]error{nil}, 3, nil, 1},
+		{[]error{aborted, nil}, 3, nil, 2},
+		{[]error{unavailable, aborted, nil}, 3, nil, 3},
+		{[]error{aborted, aborted, aborted, nil}, 3, aborted, 3},
+		{[]error{internal, nil}, 3, internal, 1},
+		{[]error{conflict, nil}, 3, conflict, 1},
+		{[]error{aborted, conflict, nil}, 3, conflict, 2},
+		{[]error{aborted, nil}, 1, aborted, 1},
+	}
+
+	for _, c := range cases {
+		var calls, sleeps int
+		sleep := func(context.Context, time.Duration) error {
+			sleeps++
+			return nil
+		}
+		err := retryTransaction(context.Background(), c.attempts, sleep, func() error {
+			err := c.errs[calls]
+			calls++
+			return err
+		})
+		assert.Equal(t, c.err, err)
+		assert.Equal(t, c.calls, calls)
+		assert.Equal(t, c.calls-1, sleeps)
+	}
+
+	// Retrying stops if the context is done while sleeping.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := 0
+	err := retryTransaction(ctx, 3, sleepContext, func() error {
+		calls++
+		return aborted
+	})
+	assert.Equal(t, aborted, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestRunTransactionAttempts(t *testing.T) {
+	defer func(f func(context.Context, *firestore.Client, func(context.Context, *firestore.Transaction) error, ...firestore.TransactionOption) error) {
+		runFirestoreTransaction = f
+	}(runFirestoreTransaction)
+
+	// Fake the Firestore client, which attempts each transaction up to 5
+	// times unless told otherwise, and whose commits always abort.
+	aborted := status.Error(codes.Aborted, "aborted")
+	runFirestoreTransaction = func(ctx context.Context, client *firestore.Client, f func(context.Context, *firestore.Transaction) error, opts ...firestore.TransactionOption) error {
+		attempts := 5
+		for _, opt := range opts {
+			if reflect.DeepEqual(opt, firestore.MaxAttempts(1)) {
+				attempts = 1
+			}
+		}
+		for i := 0; i < attempts; i++ {
+			if err := f(ctx, nil); err != nil {
+				return err
+			}
+		}
+		return aborted
+	}
+
+	ctx := &Context{Context: context.Background(), client: &firestore.Client{}}
+	calls := 0
+	err := RunTransaction(ctx, func(context.Context, *firestore.Transaction) error {
+		calls++
+		return nil
+	})
+	assert.Equal(t, http.StatusInternalServerError, err.HTTPStatusCode())
+	// Only our own retries apply.
+	assert.Equal(t, defaultTransactionAttempts, calls)
+}
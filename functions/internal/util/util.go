@@ -7,10 +7,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
 	"os"
 	"strings"
-	"regexp"
+	"strconv"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/firestore"
 	"google.golang.org/grpc/codes"
@@ -23,14 +27,77 @@ type Context struct {
 	resp   http.ResponseWriter
 	req    *http.Request
 	client *firestore.Client
+	flags  map[string]bool
+	// Returns the current time; see WithClock.
+	clock func() time.Time
+	// The time at which the request was received according to clock; see
+	// RequestTime.
+	requestTime time.Time
+	// Set by MakeHTTPHandler.
+	requestID string
+	logger    *Logger
 
 	context.Context
 }
 
-// NewContext constructs a new Context from an http.ResponseWriter and an
-// *http.Request.
-func NewContext(w http.ResponseWriter, r *http.Request) (Context, StatusError) {
-	ctx := r.Context()
+// A ContextOption configures a Context constructed by NewContext.
+type ContextOption func(*Context)
+
+// WithClock configures a Context to use now as its source of the current time
+// instead of time.Now. This allows staging environments to exercise the real
+// Firestore code paths while controlling time (e.g., to test expiration
+// without waiting).
+func WithClock(now func() time.Time) ContextOption {
+	return func(c *Context) {
+		c.clock = now
+	}
+}
+
+// WithFirestoreClient configures a Context to use client instead of the
+// client shared by all requests (see sharedFirestoreClient). This allows tests
+// to inject their own (e.g., emulator-backed) client.
+func WithFirestoreClient(client *firestore.Client) ContextOption {
+	return func(c *Context) {
+		c.client = client
+	}
+}
+
+// newFirestoreClient constructs a *firestore.Client. Tests may replace it.
+var newFirestoreClient = func(ctx context.Context, projectID string) (*firestore.Client, error) {
+	return firestore.NewClient(ctx, projectID)
+}
+
+// closeFirestoreClient closes a *firestore.Client constructed by
+// newFirestoreClient. Tests may replace it.
+var closeFirestoreClient = func(client *firestore.Client) error {
+	return client.Close()
+}
+
+var (
+	sharedClientMu sync.Mutex
+	sharedClient   *firestore.Client
+	// Set by CloseFirestoreClient.
+	sharedClientClosed bool
+)
+
+var firestoreClientClosedError = errors.New("firestore client is closed")
+
+// sharedFirestoreClient returns the *firestore.Client shared by all requests,
+// constructing it on first use. Constructing a client establishes a new gRPC
+// connection, which is expensive, while a single client is safe for concurrent
+// use. If construction fails, it is attempted again on the next call.
+//
+// The FIRESTORE_EMULATOR_HOST environment variable is only consulted when the
+// client is constructed.
+func sharedFirestoreClient() (*firestore.Client, error) {
+	sharedClientMu.Lock()
+	defer sharedClientMu.Unlock()
+	if sharedClientClosed {
+		return nil, firestoreClientClosedError
+	}
+	if sharedClient != nil {
+		return sharedClient, nil
+	}
 
 	// In production, automatically detect credentials from the environment.
 	projectID := firestore.DetectProjectID
@@ -40,13 +107,87 @@ func NewContext(w http.ResponseWriter, r *http.Request) (Context, StatusError) {
 		// the call will fail.
 		projectID = "test"
 	}
-	client, err := firestore.NewClient(ctx, projectID)
+	// The client outlives any one request, so it must not be bound to a
+	// request's context.
+	client, err := newFirestoreClient(context.Background(), projectID)
 	if err != nil {
-		err := NewInternalServerError(err)
-		return Context{}, err
+		return nil, err
+	}
+	sharedClient = client
+	return client, nil
+}
+
+// CloseFirestoreClient closes the Firestore client shared by all requests, if
+// it has been constructed. It should be called when the process is shutting
+// down, after in-flight requests have completed. Once it has been called,
+// NewContext fails with a StatusError whose HTTPStatusCode method returns
+// http.StatusServiceUnavailable unless WithFirestoreClient is given. It is safe
+// to call more than once; subsequent calls do nothing and return nil.
+func CloseFirestoreClient() error {
+	sharedClientMu.Lock()
+	defer sharedClientMu.Unlock()
+	if sharedClientClosed {
+		return nil
 	}
+	sharedClientClosed = true
 
-	return Context{w, r, client, ctx}, nil
+	client := sharedClient
+	sharedClient = nil
+	if client == nil {
+		return nil
+	}
+	return closeFirestoreClient(client)
+}
+
+// NewContext constructs a new Context from an http.ResponseWriter and an
+// *http.Request, configured by the given options. Unless WithFirestoreClient
+// is given, the Context uses the Firestore client shared by all requests.
+func NewContext(w http.ResponseWriter, r *http.Request, opts ...ContextOption) (Context, StatusError) {
+	c := Context{
+		resp:    w,
+		req:     r,
+		flags:   requestFeatureFlags(r),
+		clock:   time.Now,
+		Context: r.Context(),
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	if c.client == nil {
+		client, err := sharedFirestoreClient()
+		if err == firestoreClientClosedError {
+			// The process is shutting down; another instance can serve the
+			// request.
+			return Context{}, NewServiceUnavailableError(err, firestoreRetryAfter)
+		} else if err != nil {
+			return Context{}, NewInternalServerError(err)
+		}
+		c.client = client
+	}
+	c.requestTime = c.Now()
+	return c, nil
+}
+
+// Now returns the current time according to c's clock (see WithClock). It
+// should be used instead of time.Now for anything which affects behavior, such
+// as expirations. Contexts not constructed by NewContext use time.Now.
+func (c *Context) Now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock()
+}
+
+// RequestTime returns the time at which the request was received according to
+// c's clock. Unlike Now, it returns the same value every time it is called, so
+// it should be used when several values derived from the current time (such as
+// an issuance time and an expiration) must be consistent with one another.
+func (c *Context) RequestTime() time.Time {
+	if c.requestTime.IsZero() {
+		c.requestTime = c.Now()
+	}
+	return c.requestTime
 }
 
 // HTTPRequest returns the *http.Request that was used to construct this
@@ -61,17 +202,118 @@ func (c *Context) HTTPResponseWriter() http.ResponseWriter {
 	return c.resp
 }
 
+// RequestID returns the correlation ID of this request, which is echoed to the
+// client in the X-Request-Id response header and included in logs.
+func (c *Context) RequestID() string {
+	return c.requestID
+}
+
 // FirestoreClient returns the firestore Client.
 func (c *Context) FirestoreClient() *firestore.Client {
 	return c.client
 }
 
+// WithContext returns a shallow copy of c whose context.Context is ctx, which
+// should be derived from c. It is used to pass values such as the current span
+// (see StartSpan) to operations performed using the returned Context.
+func (c *Context) WithContext(ctx context.Context) *Context {
+	c2 := *c
+	c2.Context = ctx
+	return &c2
+}
+
+const defaultFirestoreTimeout = 10 * time.Second
+
+// firestoreTimeout returns the timeout for individual Firestore operations. It
+// is read from the FIRESTORE_TIMEOUT environment variable, which is parsed
+// using time.ParseDuration. If the variable is unset, or its value is invalid
+// or not positive, defaultFirestoreTimeout is used.
+func firestoreTimeout() time.Duration {
+	s := os.Getenv("FIRESTORE_TIMEOUT")
+	if s == "" {
+		return defaultFirestoreTimeout
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		DefaultLogger.Warningf("ignoring invalid FIRESTORE_TIMEOUT %q", s)
+		return defaultFirestoreTimeout
+	}
+	return d
+}
+
+// WithFirestoreTimeout returns a child of c which is cancelled after the
+// configured Firestore operation timeout. It should be used for every
+// Firestore operation (or transaction) so that a slow backend can't hang the
+// request indefinitely. The returned context.CancelFunc must be called once the
+// operation has completed. Errors resulting from the timeout are converted to
+// an appropriate StatusError by FirestoreToStatusError.
+func (c *Context) WithFirestoreTimeout() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Context, firestoreTimeout())
+}
+
+// Logger returns a *Logger which adds the request's ID and endpoint to every
+// entry. If c was not constructed by MakeHTTPHandler, DefaultLogger is
+// returned.
+func (c *Context) Logger() *Logger {
+	if c.logger == nil {
+		return DefaultLogger
+	}
+	return c.logger
+}
+
+// Flag returns whether the named feature flag is enabled for this request. See
+// the documentation in flags.go for how flags are configured.
+func (c *Context) Flag(name string) bool {
+	return c.flags[name]
+}
+
 // ValidateRequestMethod validates that ctx.HTTPRequest().Method == method, and
-// if not, returns an appropriate StatusError.
+// if not, returns an appropriate StatusError whose response includes an Allow
+// header listing method. If method is "GET", then "HEAD" is also accepted, as
+// RFC 7231 requires; the "net/http" package discards the body of responses to
+// HEAD requests, but handlers whose responses have side effects (such as
+// storing something in the database) should skip them for HEAD requests.
 func ValidateRequestMethod(ctx *Context, method, err string) StatusError {
 	m := ctx.HTTPRequest().Method
+	if method == "GET" {
+		if m != "GET" && m != "HEAD" {
+			return NewMethodNotAllowedError(m, "GET", "HEAD")
+		}
+		return nil
+	}
 	if m != method {
-		return NewMethodNotAllowedError(m)
+		return NewMethodNotAllowedError(m, method)
+	}
+	return nil
+}
+
+// ValidateContentType validates that the media type of the Content-Type header
+// of ctx.HTTPRequest() is contentType, and if not, returns an appropriate
+// StatusError. Parameters such as charset are ignored, so if contentType is
+// "application/json", then "application/json; charset=utf-8" is accepted.
+func ValidateContentType(ctx *Context, contentType string) StatusError {
+	ct := ctx.HTTPRequest().Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil || mediaType != contentType {
+		return NewUnsupportedMediaTypeError(ct)
+	}
+	return nil
+}
+
+var missingUserAgentError = errors.New("a User-Agent header identifying the client is required")
+
+// ValidateUserAgent validates that ctx.HTTPRequest() has a non-empty User-Agent
+// header, and if not, returns an appropriate StatusError. The check is only
+// performed if the REQUIRE_USER_AGENT environment variable is set to a true
+// value (as parsed by strconv.ParseBool); by default, all requests pass so that
+// minimal clients are not broken.
+func ValidateUserAgent(ctx *Context) StatusError {
+	if required, _ := strconv.ParseBool(os.Getenv("REQUIRE_USER_AGENT")); !required {
+		return nil
+	}
+	if strings.TrimSpace(ctx.HTTPRequest().Header.Get("User-Agent")) == "" {
+		return NewBadRequestError(missingUserAgentError)
 	}
 	return nil
 }
@@ -86,20 +328,100 @@ type StatusError interface {
 	// Message returns a string which will be used as the contents of the
 	// "message" field in the JSON object which is sent as the response body.
 	Message() string
+	// Code returns a stable, machine-readable identifier for this error which
+	// will be used as the contents of the "code" field in the JSON object
+	// which is sent as the response body. Unlike Message, clients may rely on
+	// the value returned by Code not changing.
+	Code() string
 }
 
+// Machine-readable error codes returned by StatusError.Code. These are part of
+// the API, and are documented in API.md.
+const (
+	CodeBadRequest           = "bad_request"
+	CodeNotFound             = "not_found"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeConflict             = "conflict"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodePayloadTooLarge      = "payload_too_large"
+	CodeRateLimited          = "rate_limited"
+	CodeTimeout              = "timeout"
+	CodeCanceled             = "canceled"
+	CodeUnavailable          = "unavailable"
+	CodeExpectationFailed    = "expectation_failed"
+	CodeOriginNotAllowed     = "origin_not_allowed"
+	CodeHTTPSRequired        = "https_required"
+	CodeInternal             = "internal_error"
+)
+
 type statusError struct {
 	code int
+	// If errorCode is non-empty, then Code will return it. Otherwise, Code
+	// will return a default based on code.
+	errorCode string
 	// If message is non-empty, then Message will return it. Otherwise, Message
 	// will return error.Error().
 	message string
+	// Headers which will be set on the response in addition to the default
+	// ones. May be nil.
+	header http.Header
 	error
 }
 
+// headerer is implemented by StatusErrors which require extra headers to be
+// set on the response.
+type headerer interface {
+	Header() http.Header
+}
+
+func (e statusError) Header() http.Header {
+	return e.header
+}
+
 func (e statusError) HTTPStatusCode() int {
 	return e.code
 }
 
+func (e statusError) Code() string {
+	if e.errorCode != "" {
+		return e.errorCode
+	}
+	return defaultErrorCode(e.code)
+}
+
+// defaultErrorCode returns the error code used for statusErrors with the given
+// HTTP status code which don't specify an error code explicitly.
+func defaultErrorCode(code int) string {
+	switch code {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMediaType
+	case http.StatusRequestEntityTooLarge:
+		return CodePayloadTooLarge
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	case statusClientClosedRequest:
+		return CodeCanceled
+	default:
+		return CodeInternal
+	}
+}
+
 func (e statusError) Message() string {
 	if e.message != "" {
 		return e.message
@@ -116,8 +438,9 @@ func NewInternalServerError(err error) StatusError {
 		// We don't want to leak any potentially sensitive data that might be
 		// contained in the error. This message will be sent to the client
 		// instead of err.Error().
-		message: "internal server error",
-		error:   err,
+		message:   "internal server error",
+		errorCode: CodeInternal,
+		error:     err,
 	}
 }
 
@@ -125,59 +448,246 @@ func NewInternalServerError(err error) StatusError {
 // returns http.StatusBadRequest and whose Message method returns err.Error().
 func NewBadRequestError(err error) StatusError {
 	return statusError{
-		code:  http.StatusBadRequest,
-		error: err,
+		code:      http.StatusBadRequest,
+		errorCode: CodeBadRequest,
+		error:     err,
 	}
 }
 
 // NewMethodNotAllowedError wraps err in a StatusError whose HTTPStatusCode
 // method returns http.StatusMethodNotAllowed and whose Message method returns
-// "unsupported method: " followed by the given method string.
+// "unsupported method: " followed by the given method string. As required by
+// RFC 7231, the response will include an Allow header listing the allowed
+// methods, if any are given.
+func NewMethodNotAllowedError(method string, allowed ...string) StatusError {
+	var header http.Header
+	if len(allowed) > 0 {
+		header = make(http.Header)
+		header.Set("Allow", strings.Join(allowed, ", "))
+	}
+	return statusError{
+		code:      http.StatusMethodNotAllowed,
+		errorCode: CodeMethodNotAllowed,
+		header:    header,
+		error:     fmt.Errorf("unsupported method: %v", method),
+	}
+}
+
+// NewUnauthorizedError wraps err in a StatusError whose HTTPStatusCode method
+// returns http.StatusUnauthorized and whose Message method returns err.Error().
+// As required by RFC 7235, the response will include a WWW-Authenticate header
+// containing the given challenges, or indicating that the Bearer scheme is
+// expected if none are given.
+func NewUnauthorizedError(err error, challenges ...string) StatusError {
+	if len(challenges) == 0 {
+		challenges = []string{"Bearer"}
+	}
+	header := make(http.Header)
+	header.Set("WWW-Authenticate", strings.Join(challenges, ", "))
+	return statusError{
+		code:      http.StatusUnauthorized,
+		errorCode: CodeUnauthorized,
+		header:    header,
+		error:     err,
+	}
+}
+
+// NewForbiddenError wraps err in a StatusError whose HTTPStatusCode method
+// returns http.StatusForbidden and whose Message method returns err.Error(). It
+// should be used when the client is authenticated (or authentication is
+// irrelevant) but is not permitted to perform the request.
+func NewForbiddenError(err error) StatusError {
+	return statusError{
+		code:      http.StatusForbidden,
+		errorCode: CodeForbidden,
+		error:     err,
+	}
+}
+
+// NewConflictError wraps err in a StatusError whose HTTPStatusCode method
+// returns http.StatusConflict and whose Message method returns err.Error(). It
+// should be used when a request conflicts with the current state of a
+// resource, such as when a resource which the request would create already
+// exists.
+func NewConflictError(err error) StatusError {
+	return statusError{
+		code:      http.StatusConflict,
+		errorCode: CodeConflict,
+		error:     err,
+	}
+}
+
+// NewUnsupportedMediaTypeError returns a StatusError whose HTTPStatusCode
+// method returns http.StatusUnsupportedMediaType and whose Message method
+// returns "unsupported content type: " followed by the given content type.
+func NewUnsupportedMediaTypeError(contentType string) StatusError {
+	return statusError{
+		code:      http.StatusUnsupportedMediaType,
+		errorCode: CodeUnsupportedMediaType,
+		error:     fmt.Errorf("unsupported content type: %q", contentType),
+	}
+}
 
-func NewMethodNotAllowedError(method string) StatusError {
+// NewTooManyRequestsError wraps err in a StatusError whose HTTPStatusCode
+// method returns http.StatusTooManyRequests and whose Message method returns
+// err.Error(). The response will include a Retry-After header instructing the
+// client to wait for retryAfter (rounded up to the nearest second) before
+// retrying.
+func NewTooManyRequestsError(err error, retryAfter time.Duration) StatusError {
 	return statusError{
-		code:  http.StatusMethodNotAllowed,
-		error: fmt.Errorf("unsupported method: %v", method),
+		code:      http.StatusTooManyRequests,
+		errorCode: CodeRateLimited,
+		header:    retryAfterHeader(retryAfter),
+		error:     err,
+	}
+}
+
+// NewServiceUnavailableError wraps err in a StatusError whose HTTPStatusCode
+// method returns http.StatusServiceUnavailable and whose Message method returns
+// "service temporarily unavailable" to avoid leaking potentially sensitive data
+// from err. The response will include a Retry-After header instructing the
+// client to wait for retryAfter (rounded up to the nearest second) before
+// retrying.
+func NewServiceUnavailableError(err error, retryAfter time.Duration) StatusError {
+	return statusError{
+		code:      http.StatusServiceUnavailable,
+		errorCode: CodeUnavailable,
+		message:   "service temporarily unavailable",
+		header:    retryAfterHeader(retryAfter),
+		error:     err,
+	}
+}
+
+// retryAfterHeader returns a header containing a Retry-After field for the
+// given duration, rounded up to the nearest second (and at least one second).
+func retryAfterHeader(retryAfter time.Duration) http.Header {
+	secs := int64((retryAfter + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
 	}
+
+	header := make(http.Header)
+	header.Set("Retry-After", strconv.FormatInt(secs, 10))
+	return header
 }
 
 var (
-	notFoundError = NewBadRequestError(errors.New("not found"))
+	notFoundError = statusError{
+		code:      http.StatusBadRequest,
+		errorCode: CodeNotFound,
+		error:     errors.New("not found"),
+	}
 )
 
+// How long clients are asked to wait before retrying after a transient
+// Firestore failure.
+const firestoreRetryAfter = time.Second
+
+// The non-standard status code (originating with nginx) used for requests
+// which were canceled, usually because the client disconnected, before a
+// response was ready. The "net/http" package doesn't define it.
+const statusClientClosedRequest = 499
+
 // FirestoreToStatusError converts an error returned from the
-// "cloud.google.com/go/firestore" package to a StatusError.
+// "cloud.google.com/go/firestore" package to a StatusError. Transient failures
+// (the database being unavailable or a deadline being exceeded) are mapped to
+// http.StatusServiceUnavailable so that clients know to retry. Cancellation,
+// which is usually caused by the client disconnecting rather than by a fault,
+// is mapped to statusClientClosedRequest.
 func FirestoreToStatusError(err error) StatusError {
-	if status.Code(err) == codes.NotFound {
+	switch {
+	case status.Code(err) == codes.NotFound:
 		return notFoundError
+	case status.Code(err) == codes.Unavailable:
+		return NewServiceUnavailableError(err, firestoreRetryAfter)
+	case status.Code(err) == codes.DeadlineExceeded, errors.Is(err, context.DeadlineExceeded):
+		return statusError{
+			code:      http.StatusServiceUnavailable,
+			errorCode: CodeTimeout,
+			message:   "timed out waiting for the database",
+			header:    retryAfterHeader(firestoreRetryAfter),
+			error:     err,
+		}
+	case status.Code(err) == codes.Canceled, errors.Is(err, context.Canceled):
+		return statusError{
+			code:      statusClientClosedRequest,
+			errorCode: CodeCanceled,
+			message:   "request canceled",
+			error:     err,
+		}
 	}
 
 	return NewInternalServerError(err)
 }
 
 // JSONToStatusError converts an error returned from the "encoding/json" package
-// to a StatusError. It assumes that all error types defined in the
-// "encoding/json" package and io.EOF are bad request errors and all others are
-// internal server errors.
+// to a StatusError. Errors which are already StatusErrors (e.g., those returned
+// from a type's UnmarshalJSON method) are returned unchanged. Otherwise, it
+// assumes that all error types defined in the "encoding/json" package, unknown
+// field errors produced by (*json.Decoder).DisallowUnknownFields, io.EOF, and
+// io.ErrUnexpectedEOF are bad request errors and all others are internal
+// server errors.
 func JSONToStatusError(err error) StatusError {
 	switch err := err.(type) {
+	case StatusError:
+		return err
 	case *json.MarshalerError, *json.SyntaxError, *json.UnmarshalFieldError,
 		*json.UnmarshalTypeError, *json.UnsupportedTypeError, *json.UnsupportedValueError:
 		return NewBadRequestError(err)
 	default:
-		if err == io.EOF {
+		// The "encoding/json" package doesn't export a type for unknown field
+		// errors, so we have to match on the message, which names the field.
+		if err == io.EOF || err == io.ErrUnexpectedEOF ||
+			strings.HasPrefix(err.Error(), "json: unknown field ") {
 			return NewBadRequestError(err)
 		}
 		return NewInternalServerError(err)
 	}
 }
 
-// ReadCryptoRandBytes fills b with cryptographically random bytes from the
-// "crypto/rand" package. It always fills all of b.
+// DecodeStrictJSON decodes the JSON request body into v. Unlike a plain
+// json.Decoder, it rejects bodies containing fields which don't correspond to
+// any field of v, so that clients which misspell a field get a clear error
+// rather than having it silently ignored. It also rejects bodies containing
+// anything other than whitespace after the top-level value, which could
+// otherwise mask malformed or smuggled payloads. Errors are converted using
+// JSONToStatusError.
+func (c *Context) DecodeStrictJSON(v interface{}) StatusError {
+	dec := json.NewDecoder(c.HTTPRequest().Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return JSONToStatusError(err)
+	}
+	// We can't use dec.More here, since it returns false if the next token is
+	// a closing delimiter, even at the top level.
+	if _, err := dec.Token(); err != io.EOF {
+		return NewBadRequestError(trailingDataError)
+	}
+	return nil
+}
+
+var trailingDataError = errors.New("unexpected data after JSON body")
+
+// RandReader is the source of the bytes returned by ReadCryptoRandBytes. It is
+// rand.Reader from the "crypto/rand" package, and must remain so in production.
+// Tests may replace it in order to make otherwise random values (such as
+// challenge nonces and request IDs) deterministic.
+var RandReader io.Reader = rand.Reader
+
+// TryReadCryptoRandBytes fills b with cryptographically random bytes from
+// RandReader. If it returns nil, all of b has been filled.
+func TryReadCryptoRandBytes(b []byte) error {
+	if _, err := io.ReadFull(RandReader, b); err != nil {
+		return fmt.Errorf("could not read random bytes: %v", err)
+	}
+	return nil
+}
+
+// ReadCryptoRandBytes is like TryReadCryptoRandBytes, except that it panics on
+// error. It should only be used where there is no way to report an error.
 func ReadCryptoRandBytes(b []byte) {
-	_, err := rand.Read(b)
-	if err != nil {
-		panic(fmt.Errorf("could not read random bytes: %v", err))
+	if err := TryReadCryptoRandBytes(b); err != nil {
+		panic(err)
 	}
 }
 
@@ -205,27 +715,121 @@ var (
 	// De-facto standard header keys.
 	xForwardedProto = http.CanonicalHeaderKey("X-Forwarded-Proto")
 	forwarded       = http.CanonicalHeaderKey("Forwarded") // RFC7239
-	
-	protoRegex 		= regexp.MustCompile(`(?i)(?:proto=)(https|http)`)
 )
 
+// splitUnquoted splits s around each instance of sep which is not within a
+// quoted string (as defined by RFC 7230). ok is false if s contains an
+// unterminated quoted string.
+func splitUnquoted(s string, sep byte) (parts []string, ok bool) {
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			// Skip the escaped character.
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, false
+	}
+	return append(parts, s[start:]), true
+}
+
+// forwardedParam returns the value of the parameter with the given name in an
+// element of an RFC 7239 Forwarded header, unquoting it if necessary. ok is
+// false if the element is malformed or has no such parameter.
+func forwardedParam(element, name string) (value string, ok bool) {
+	pairs, ok := splitUnquoted(element, ';')
+	if !ok {
+		return "", false
+	}
+
+	for _, pair := range pairs {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.IndexByte(pair, '=')
+		if i <= 0 {
+			return "", false
+		}
+		key, v := pair[:i], pair[i+1:]
+		if !strings.EqualFold(key, name) {
+			continue
+		}
+		if value != "" {
+			// RFC 7239 forbids repeating a parameter within an element.
+			return "", false
+		}
+		if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+			// Unquote the value. splitUnquoted has already verified that the
+			// closing quote isn't escaped.
+			var b strings.Builder
+			for i := 1; i < len(v)-1; i++ {
+				if v[i] == '\\' {
+					i++
+				}
+				b.WriteByte(v[i])
+			}
+			v = b.String()
+		}
+		if v == "" {
+			return "", false
+		}
+		value = v
+	}
+	return value, value != ""
+}
+
+// forwardedProto returns the value of the proto parameter of the first
+// element of the value of an RFC 7239 Forwarded header. Each proxy appends an
+// element, so the first is the one describing the request as sent by the
+// client. ok is false if that element is malformed or has no proto parameter.
+func forwardedProto(header string) (proto string, ok bool) {
+	elements, ok := splitUnquoted(header, ',')
+	if !ok {
+		return "", false
+	}
+	return forwardedParam(elements[0], "proto")
+}
+
+// isHTTPSExempt returns true if the client which sent r has an IP address
+// within one of the ranges in the HTTPS_EXEMPT_CIDRS environment variable, which
+// is a comma-separated list of CIDR ranges. This allows trusted internal callers
+// such as health-check probes to use plain HTTP. The client's IP address is
+// determined as in clientIP, so it cannot be spoofed using X-Forwarded-For. If
+// HTTPS_EXEMPT_CIDRS is unset, no clients are exempt.
+func isHTTPSExempt(r *http.Request) bool {
+	exempt := httpsExemptCIDRs.get()
+	if len(exempt) == 0 {
+		return false
+	}
+	return containsIP(exempt, net.ParseIP(clientIP(r)))
+}
+
+// httpsExemptCIDRs holds the ranges in the HTTPS_EXEMPT_CIDRS environment
+// variable.
+var httpsExemptCIDRs = &cidrEnv{name: "HTTPS_EXEMPT_CIDRS"}
+
 func checkHTTPS(r *http.Request) StatusError {
+	if isHTTPSExempt(r) {
+		return nil
+	}
+
 	var scheme string
 
 	// Retrieve the scheme from X-Forwarded-Proto.
 	if proto := r.Header.Get(xForwardedProto); proto != "" {
 		scheme = strings.ToLower(proto)
-	} else if proto = r.Header.Get(forwarded); proto != "" {
-		// match should contain at least two elements if the protocol was
-		// specified in the Forwarded header. The first element will always be
-		// the 'proto=' capture, which we ignore. In the case of multiple proto
-		// parameters (invalid) we only extract the first.
-		if match := protoRegex.FindStringSubmatch(proto); len(match) == 2 {
-			scheme = strings.ToLower(match[1])
-		} else if len(match) > 2 {
-			return NewInternalServerError(
-				fmt.Errorf("Header 'forward' has more than 2 elements"))
-		}
+	} else if proto, ok := forwardedProto(r.Header.Get(forwarded)); ok {
+		// If the header is malformed, scheme is left empty, and the request
+		// is rejected below as if it had used HTTP.
+		scheme = strings.ToLower(proto)
 	}
 
 	// We want to ensure that clients always use HTTPS. Even if we don't
@@ -251,13 +855,42 @@ func checkHTTPS(r *http.Request) StatusError {
 	// automatically upgrade to HTTPS, and it is guaranteed to get a
 	// developer's attention, hopefully getting them to look at the
 	// response body, which will contain the relevant information.
+	//
+	// Some API gateways and clients treat 418 as an unknown error, however, so
+	// deployments may instead opt into the semantically correct 426 Upgrade
+	// Required; see httpRejectStatus.
 	if scheme != "https" {
-		return newStatusError(http.StatusTeapot,
+		err := newStatusError(httpRejectStatus(),
 			errors.New("unsupported protocol HTTP; only HTTPS is supported"))
+		err.errorCode = CodeHTTPSRequired
+		if err.code == http.StatusUpgradeRequired {
+			// RFC 7231 requires 426 responses to include an Upgrade header.
+			err.header = http.Header{}
+			err.header.Set("Upgrade", "TLS/1.2, HTTP/1.1")
+			err.header.Set("Connection", "Upgrade")
+		}
+		return err
 	}
 	return nil
 }
 
+// httpRejectStatus returns the status code used to reject requests made over
+// plain HTTP. It is read from the HTTP_REJECT_STATUS environment variable,
+// which may be 418 (the default) or 426. Other values are logged and ignored.
+func httpRejectStatus() int {
+	s := os.Getenv("HTTP_REJECT_STATUS")
+	if s == "" {
+		return http.StatusTeapot
+	}
+
+	code, err := strconv.Atoi(s)
+	if err != nil || (code != http.StatusTeapot && code != http.StatusUpgradeRequired) {
+		DefaultLogger.Warningf("ignoring invalid HTTP_REJECT_STATUS %q (must be %v or %v)", s, http.StatusTeapot, http.StatusUpgradeRequired)
+		return http.StatusTeapot
+	}
+	return code
+}
+
 // Add HSTS to force HTTPS usage.
 // https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Strict-Transport-Security
 // In the following example, max-age is set to 2 years, raised from what was a former
@@ -266,7 +899,110 @@ func checkHTTPS(r *http.Request) StatusError {
 // website's final HSTS configuration as explained on https://hstspreload.org.
 // It also suffixed with preload which is necessary for inclusion in most major web
 // browsers' HSTS preload lists, e.g. Chromium, Edge, & Firefox.
+//
+// Deployments on subdomains of domains they don't control may not be able to
+// send includeSubDomains or preload safely, so each directive can be
+// configured; see hstsValue.
 var headerHSTS = http.CanonicalHeaderKey("Strict-Transport-Security")
+
+const defaultHSTSMaxAge = 63072000
+
+// envBool parses the named environment variable using strconv.ParseBool. If
+// the variable is unset or invalid, def is returned (and invalid values are
+// logged).
+func envBool(name string, def bool) bool {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		DefaultLogger.Warningf("ignoring invalid %v %q", name, s)
+		return def
+	}
+	return b
+}
+
+// hstsValue returns the value of the Strict-Transport-Security header, or the
+// empty string if the header should not be sent. It is configured by the
+// following environment variables:
+//   - HSTS: set to false to disable the header entirely (e.g., in
+//     non-production environments)
+//   - HSTS_MAX_AGE: the max-age directive, in seconds
+//   - HSTS_INCLUDE_SUBDOMAINS: set to false to omit includeSubDomains
+//   - HSTS_PRELOAD: set to false to omit preload
+//
+// The defaults produce "max-age=63072000; includeSubDomains; preload".
+func hstsValue() string {
+	if !envBool("HSTS", true) {
+		return ""
+	}
+
+	maxAge := uint64(defaultHSTSMaxAge)
+	if s := os.Getenv("HSTS_MAX_AGE"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			DefaultLogger.Warningf("ignoring invalid HSTS_MAX_AGE %q", s)
+		} else {
+			maxAge = n
+		}
+	}
+
+	v := "max-age=" + strconv.FormatUint(maxAge, 10)
+	if envBool("HSTS_INCLUDE_SUBDOMAINS", true) {
+		v += "; includeSubDomains"
+	}
+	if envBool("HSTS_PRELOAD", true) {
+		v += "; preload"
+	}
+	return v
+}
+
 func addHSTS(w http.ResponseWriter) {
-	w.Header().Set(headerHSTS, "max-age=63072000; includeSubDomains; preload")
+	if v := hstsValue(); v != "" {
+		w.Header().Set(headerHSTS, v)
+	}
+}
+
+var (
+	headerContentTypeOptions = http.CanonicalHeaderKey("X-Content-Type-Options")
+	headerFrameOptions       = http.CanonicalHeaderKey("X-Frame-Options")
+	headerCSP                = http.CanonicalHeaderKey("Content-Security-Policy")
+)
+
+// Our responses are only ever JSON, so nothing they contain should ever be
+// loaded or executed by a browser.
+const defaultCSP = "default-src 'none'; frame-ancestors 'none'"
+
+// Add headers which prevent browsers from interpreting our responses as
+// anything other than inert data, in case a response is ever viewed in a
+// browser (e.g., an error response during development):
+//  - X-Frame-Options: DENY prevents responses from being framed
+//  - Content-Security-Policy defaults to defaultCSP, and can be overridden
+//    using the CONTENT_SECURITY_POLICY environment variable
+//
+// These headers can be disabled by setting the SECURITY_HEADERS environment
+// variable to "false". The X-Content-Type-Options header is always added (see
+// addNoSniff).
+func addSecurityHeaders(w http.ResponseWriter) {
+	addNoSniff(w)
+	if enabled, err := strconv.ParseBool(os.Getenv("SECURITY_HEADERS")); err == nil && !enabled {
+		return
+	}
+
+	csp := os.Getenv("CONTENT_SECURITY_POLICY")
+	if csp == "" {
+		csp = defaultCSP
+	}
+
+	w.Header().Set(headerFrameOptions, "DENY")
+	w.Header().Set(headerCSP, csp)
+}
+
+// Add X-Content-Type-Options: nosniff, which prevents browsers from
+// MIME-sniffing a response into an executable content type. Unlike the other
+// security headers, this is never disabled, since our responses always set an
+// accurate Content-Type.
+func addNoSniff(w http.ResponseWriter) {
+	w.Header().Set(headerContentTypeOptions, "nosniff")
 }
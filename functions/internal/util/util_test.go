@@ -0,0 +1,596 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorCodes(t *testing.T) {
+	type testCase struct {
+		err        StatusError
+		statusCode int
+		code       string
+	}
+
+	err := errors.New("error")
+	cases := []testCase{
+		{NewInternalServerError(err), http.StatusInternalServerError, CodeInternal},
+		{NewBadRequestError(err), http.StatusBadRequest, CodeBadRequest},
+		{NewMethodNotAllowedError("PUT"), http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{NewConflictError(err), http.StatusConflict, CodeConflict},
+		{NewUnauthorizedError(err), http.StatusUnauthorized, CodeUnauthorized},
+		{NewForbiddenError(err), http.StatusForbidden, CodeForbidden},
+		{statusError{code: http.StatusUnauthorized, error: err}, http.StatusUnauthorized, CodeUnauthorized},
+		{statusError{code: http.StatusForbidden, error: err}, http.StatusForbidden, CodeForbidden},
+		{NewUnsupportedMediaTypeError("text/plain"), http.StatusUnsupportedMediaType, CodeUnsupportedMediaType},
+		{FirestoreToStatusError(status.Error(codes.NotFound, "not found")), http.StatusBadRequest, CodeNotFound},
+		{FirestoreToStatusError(status.Error(codes.Internal, "internal")), http.StatusInternalServerError, CodeInternal},
+		{FirestoreToStatusError(status.Error(codes.DeadlineExceeded, "deadline exceeded")), http.StatusServiceUnavailable, CodeTimeout},
+		{FirestoreToStatusError(status.Error(codes.Unavailable, "unavailable")), http.StatusServiceUnavailable, CodeUnavailable},
+		{NewServiceUnavailableError(err, time.Second), http.StatusServiceUnavailable, CodeUnavailable},
+		{FirestoreToStatusError(status.Error(codes.Canceled, "canceled")), statusClientClosedRequest, CodeCanceled},
+		{FirestoreToStatusError(context.Canceled), statusClientClosedRequest, CodeCanceled},
+		{statusError{code: statusClientClosedRequest, error: err}, statusClientClosedRequest, CodeCanceled},
+		{JSONToStatusError(&json.SyntaxError{}), http.StatusBadRequest, CodeBadRequest},
+		{JSONToStatusError(io.EOF), http.StatusBadRequest, CodeBadRequest},
+		{JSONToStatusError(io.ErrUnexpectedEOF), http.StatusBadRequest, CodeBadRequest},
+		{JSONToStatusError(err), http.StatusInternalServerError, CodeInternal},
+		{JSONToStatusError(NewConflictError(err)), http.StatusConflict, CodeConflict},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.statusCode, c.err.HTTPStatusCode())
+		assert.Equal(t, c.code, c.err.Code())
+	}
+}
+
+func TestFirestoreTimeout(t *testing.T) {
+	defer os.Unsetenv("FIRESTORE_TIMEOUT")
+
+	for _, env := range []string{"", "bogus", "0", "-1s"} {
+		os.Setenv("FIRESTORE_TIMEOUT", env)
+		assert.Equal(t, defaultFirestoreTimeout, firestoreTimeout())
+	}
+	os.Setenv("FIRESTORE_TIMEOUT", "250ms")
+	assert.Equal(t, 250*time.Millisecond, firestoreTimeout())
+
+	// A Firestore operation using an already-cancelled context (e.g., because
+	// the client disconnected) fails with the context's error, which should be
+	// mapped to a clean cancellation error rather than being passed through.
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ctx := Context{Context: cctx}
+	fctx, cancel := ctx.WithFirestoreTimeout()
+	defer cancel()
+	<-fctx.Done()
+
+	err := FirestoreToStatusError(fctx.Err())
+	assert.Equal(t, statusClientClosedRequest, err.HTTPStatusCode())
+	assert.Equal(t, CodeCanceled, err.Code())
+	assert.Equal(t, "request canceled", err.Message())
+
+	// A context whose deadline has passed is a timeout.
+	os.Setenv("FIRESTORE_TIMEOUT", "1ns")
+	ctx = Context{Context: context.Background()}
+	fctx, cancel = ctx.WithFirestoreTimeout()
+	defer cancel()
+	<-fctx.Done()
+	assert.Equal(t, CodeTimeout, FirestoreToStatusError(fctx.Err()).Code())
+}
+
+func TestFirestoreRetryableErrors(t *testing.T) {
+	type testCase struct {
+		err        error
+		statusCode int
+		retryAfter string
+	}
+
+	cases := []testCase{
+		{status.Error(codes.Unavailable, "unavailable"), http.StatusServiceUnavailable, "1"},
+		{status.Error(codes.DeadlineExceeded, "deadline exceeded"), http.StatusServiceUnavailable, "1"},
+		{context.DeadlineExceeded, http.StatusServiceUnavailable, "1"},
+		{status.Error(codes.Canceled, "canceled"), statusClientClosedRequest, ""},
+		{status.Error(codes.Internal, "internal"), http.StatusInternalServerError, ""},
+		{status.Error(codes.PermissionDenied, "permission denied"), http.StatusInternalServerError, ""},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/challenge", nil)
+		w := httptest.NewRecorder()
+		writeStatusError(w, r, "id", FirestoreToStatusError(c.err))
+		assert.Equal(t, c.statusCode, w.Code, "%v", c.err)
+		assert.Equal(t, c.retryAfter, w.Header().Get("Retry-After"), "%v", c.err)
+	}
+
+	// Details of the underlying error are not leaked.
+	err := NewServiceUnavailableError(errors.New("secret"), 2500*time.Millisecond)
+	assert.Equal(t, "service temporarily unavailable", err.Message())
+	assert.Equal(t, "3", err.(headerer).Header().Get("Retry-After"))
+}
+
+func TestAuthErrors(t *testing.T) {
+	type testCase struct {
+		err             StatusError
+		statusCode      int
+		wwwAuthenticate string
+	}
+
+	err := errors.New("not allowed")
+	cases := []testCase{
+		{NewUnauthorizedError(err), http.StatusUnauthorized, "Bearer"},
+		{NewUnauthorizedError(err, `Bearer realm="admin"`, "Basic"), http.StatusUnauthorized, `Bearer realm="admin", Basic`},
+		{NewForbiddenError(err), http.StatusForbidden, ""},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, "not allowed", c.err.Message())
+
+		r := httptest.NewRequest("GET", "/challenge", nil)
+		w := httptest.NewRecorder()
+		writeStatusError(w, r, "id", c.err)
+		assert.Equal(t, c.statusCode, w.Code)
+		assert.Equal(t, c.wwwAuthenticate, w.Header().Get("WWW-Authenticate"))
+		var body struct {
+			Message string `json:"message"`
+		}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&body))
+		assert.Equal(t, "not allowed", body.Message)
+	}
+}
+
+func TestDecodeStrictJSON(t *testing.T) {
+	type request struct {
+		UploadKey string `json:"upload_key"`
+		Count     int    `json:"count"`
+	}
+
+	type testCase struct {
+		body string
+		ok   bool
+		// If non-empty, the expected message of the error.
+		message string
+	}
+
+	cases := []testCase{
+		{`{"upload_key":"abc","count":1}`, true, ""},
+		{`{"upload_key":"abc"}`, true, ""},
+		{`{"uploadkey":"abc"}`, false, `json: unknown field "uploadkey"`},
+		// Note that field names are matched case-insensitively.
+		{`{"upload_Key":"abc"}`, true, ""},
+		{`{"upload_key":"abc","extra":true}`, false, `json: unknown field "extra"`},
+		{`{"upload_key":`, false, "unexpected EOF"},
+		{``, false, "EOF"},
+		{`{"count":"one"}`, false, ""},
+		{"{\"upload_key\":\"abc\"}\n  \t", true, ""},
+		{`{"upload_key":"abc"}{"upload_key":"def"}`, false, "unexpected data after JSON body"},
+		{`{"upload_key":"abc"} {`, false, "unexpected data after JSON body"},
+		{`{"upload_key":"abc"}}`, false, "unexpected data after JSON body"},
+		{`{"upload_key":"abc"}]`, false, "unexpected data after JSON body"},
+		{`{"upload_key":"abc"} garbage`, false, "unexpected data after JSON body"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/report", strings.NewReader(c.body))
+		ctx := Context{req: r}
+
+		var req request
+		err := ctx.DecodeStrictJSON(&req)
+		if c.ok {
+			assert.Nil(t, err, c.body)
+			continue
+		}
+		if assert.NotNil(t, err, c.body) {
+			assert.Equal(t, http.StatusBadRequest, err.HTTPStatusCode(), c.body)
+			if c.message != "" {
+				assert.Equal(t, c.message, err.Message(), c.body)
+			}
+		}
+	}
+}
+
+func TestSharedFirestoreClient(t *testing.T) {
+	defer func(f func(context.Context, string) (*firestore.Client, error)) { newFirestoreClient = f }(newFirestoreClient)
+	defer func(c *firestore.Client) { sharedClient = c }(sharedClient)
+	sharedClient = nil
+
+	var constructed int
+	fail := true
+	newFirestoreClient = func(ctx context.Context, projectID string) (*firestore.Client, error) {
+		constructed++
+		if fail {
+			return nil, errors.New("dial failed")
+		}
+		return &firestore.Client{}, nil
+	}
+
+	r := httptest.NewRequest("GET", "/challenge", nil)
+	w := httptest.NewRecorder()
+
+	// A failure to construct the client is an internal error, and is retried
+	// by the next request.
+	_, err := NewContext(w, r)
+	assert.Equal(t, http.StatusInternalServerError, err.HTTPStatusCode())
+	fail = false
+
+	ctx1, err := NewContext(w, r)
+	assert.Nil(t, err)
+	ctx2, err := NewContext(w, r)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, constructed)
+	assert.True(t, ctx1.FirestoreClient() == ctx2.FirestoreClient())
+
+	// An injected client is used instead of the shared one.
+	injected := &firestore.Client{}
+	ctx3, err := NewContext(w, r, WithFirestoreClient(injected))
+	assert.Nil(t, err)
+	assert.True(t, ctx3.FirestoreClient() == injected)
+	assert.Equal(t, 2, constructed)
+}
+
+func TestCloseFirestoreClient(t *testing.T) {
+	defer func(f func(context.Context, string) (*firestore.Client, error)) { newFirestoreClient = f }(newFirestoreClient)
+	defer func(c *firestore.Client) { sharedClient = c }(sharedClient)
+	defer func(f func(*firestore.Client) error) { closeFirestoreClient = f }(closeFirestoreClient)
+	defer func() { sharedClientClosed = false }()
+	sharedClient = nil
+
+	constructed := &firestore.Client{}
+	newFirestoreClient = func(ctx context.Context, projectID string) (*firestore.Client, error) {
+		return constructed, nil
+	}
+	var closed []*firestore.Client
+	closeFirestoreClient = func(client *firestore.Client) error {
+		closed = append(closed, client)
+		return nil
+	}
+
+	r := httptest.NewRequest("GET", "/challenge", nil)
+	w := httptest.NewRecorder()
+	_, err := NewContext(w, r)
+	assert.Nil(t, err)
+
+	assert.Nil(t, CloseFirestoreClient())
+	// Closing is idempotent.
+	assert.Nil(t, CloseFirestoreClient())
+	if assert.Equal(t, 1, len(closed)) {
+		assert.True(t, closed[0] == constructed)
+	}
+
+	// Requests fail cleanly once the client is closed.
+	_, err = NewContext(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, err.HTTPStatusCode())
+	assert.Equal(t, CodeUnavailable, err.Code())
+
+	// Unless a client is injected.
+	_, err = NewContext(w, r, WithFirestoreClient(&firestore.Client{}))
+	assert.Nil(t, err)
+
+	// Closing a client which was never constructed does nothing.
+	sharedClientClosed = false
+	assert.Nil(t, CloseFirestoreClient())
+	assert.Nil(t, CloseFirestoreClient())
+	assert.Equal(t, 1, len(closed))
+}
+
+func BenchmarkNewContext(b *testing.B) {
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8081")
+	defer os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+
+	r := httptest.NewRequest("GET", "/challenge", nil)
+	w := httptest.NewRecorder()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewContext(w, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8081")
+	defer os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+
+	r := httptest.NewRequest("GET", "/challenge", nil)
+	w := httptest.NewRecorder()
+
+	// By default, the real time is used.
+	ctx, err := NewContext(w, r)
+	assert.Nil(t, err)
+	before := time.Now()
+	now := ctx.Now()
+	assert.False(t, now.Before(before))
+	assert.False(t, now.After(time.Now()))
+
+	// An injected clock is used instead.
+	fake := time.Date(2020, 5, 14, 0, 0, 0, 0, time.UTC)
+	ctx, err = NewContext(w, r, WithClock(func() time.Time { return fake }))
+	assert.Nil(t, err)
+	assert.Equal(t, fake, ctx.Now())
+	fake = fake.Add(72 * time.Hour)
+	assert.Equal(t, fake, ctx.Now())
+
+	// Contexts constructed without NewContext also work.
+	assert.False(t, (&Context{}).Now().IsZero())
+}
+
+func TestRequestTime(t *testing.T) {
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8081")
+	defer os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+
+	// A clock which advances by a second every time it is read.
+	fake := time.Date(2020, 5, 14, 23, 59, 59, 0, time.UTC)
+	clock := func() time.Time {
+		fake = fake.Add(time.Second)
+		return fake
+	}
+
+	r := httptest.NewRequest("GET", "/challenge", nil)
+	ctx, err := NewContext(httptest.NewRecorder(), r, WithClock(clock))
+	assert.Nil(t, err)
+
+	// The request time is captured once and then reused, even across a
+	// second (and day) boundary.
+	requestTime := ctx.RequestTime()
+	assert.Equal(t, time.Date(2020, 5, 15, 0, 0, 0, 0, time.UTC), requestTime)
+	assert.True(t, ctx.Now().After(requestTime))
+	assert.Equal(t, requestTime, ctx.RequestTime())
+
+	// Contexts constructed without NewContext capture it on first use.
+	var c Context
+	assert.Equal(t, c.RequestTime(), c.RequestTime())
+}
+
+func TestConflictError(t *testing.T) {
+	err := NewConflictError(errors.New("upload token already exists"))
+	assert.Equal(t, http.StatusConflict, err.HTTPStatusCode())
+	assert.Equal(t, "upload token already exists", err.Message())
+}
+
+func TestValidateContentType(t *testing.T) {
+	type testCase struct {
+		contentType string
+		ok          bool
+	}
+
+	cases := []testCase{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"Application/JSON", true},
+		{"text/plain", false},
+		{"application/jsonx", false},
+		{"", false},
+		{";;", false},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/report", nil)
+		if c.contentType != "" {
+			r.Header.Set("Content-Type", c.contentType)
+		}
+		ctx := Context{req: r}
+
+		err := ValidateContentType(&ctx, "application/json")
+		if c.ok {
+			assert.Nil(t, err)
+		} else {
+			assert.Equal(t, http.StatusUnsupportedMediaType, err.HTTPStatusCode())
+		}
+	}
+}
+
+func TestValidateUserAgent(t *testing.T) {
+	defer os.Unsetenv("REQUIRE_USER_AGENT")
+
+	type testCase struct {
+		env       string
+		userAgent *string
+		ok        bool
+	}
+
+	present, empty, blank := "covidwatch-ios/1.0", "", "  "
+	cases := []testCase{
+		{"", &present, true},
+		{"", &empty, true},
+		{"", nil, true},
+		{"false", nil, true},
+		{"bogus", nil, true},
+		{"true", &present, true},
+		{"true", &empty, false},
+		{"true", &blank, false},
+		{"true", nil, false},
+	}
+
+	for _, c := range cases {
+		os.Setenv("REQUIRE_USER_AGENT", c.env)
+		r := httptest.NewRequest("POST", "/report", nil)
+		if c.userAgent != nil {
+			r.Header.Set("User-Agent", *c.userAgent)
+		} else {
+			r.Header.Del("User-Agent")
+		}
+		ctx := Context{req: r}
+
+		err := ValidateUserAgent(&ctx)
+		if c.ok {
+			assert.Nil(t, err)
+		} else {
+			assert.Equal(t, http.StatusBadRequest, err.HTTPStatusCode())
+			assert.Contains(t, err.Message(), "User-Agent")
+		}
+	}
+}
+
+func TestCheckHTTPSErrorCode(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://localhost/challenge", nil)
+	assert.Nil(t, err)
+	r.Header.Set("X-Forwarded-Proto", "http")
+
+	serr := checkHTTPS(r)
+	assert.Equal(t, http.StatusTeapot, serr.HTTPStatusCode())
+	assert.Equal(t, CodeHTTPSRequired, serr.Code())
+}
+
+func TestHTTPSExempt(t *testing.T) {
+	defer os.Unsetenv("HTTPS_EXEMPT_CIDRS")
+
+	type testCase struct {
+		env        string
+		remoteAddr string
+		xff        string
+		ok         bool
+	}
+
+	cases := []testCase{
+		// Strict by default.
+		{"", "10.0.0.1:1234", "", false},
+		{"10.0.0.0/8", "10.0.0.1:1234", "", true},
+		{"10.0.0.0/8, 192.168.1.1/32", "192.168.1.1:1234", "", true},
+		{"10.0.0.0/8", "192.168.1.1:1234", "", false},
+		// The client IP appended by the proxy is used.
+		{"10.0.0.0/8", "35.191.0.1:1234", "203.0.113.7, 10.0.0.1", true},
+		// Spoofed earlier hops are ignored.
+		{"10.0.0.0/8", "35.191.0.1:1234", "10.0.0.1, 203.0.113.7", false},
+		{"bogus", "10.0.0.1:1234", "", false},
+	}
+
+	for _, c := range cases {
+		os.Setenv("HTTPS_EXEMPT_CIDRS", c.env)
+		r := httptest.NewRequest("GET", "/challenge", nil)
+		r.RemoteAddr = c.remoteAddr
+		r.Header.Set("X-Forwarded-Proto", "http")
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+
+		err := checkHTTPS(r)
+		if c.ok {
+			assert.Nil(t, err)
+		} else {
+			assert.Equal(t, http.StatusTeapot, err.HTTPStatusCode())
+		}
+	}
+}
+
+func TestHTTPRejectStatus(t *testing.T) {
+	defer os.Unsetenv("HTTP_REJECT_STATUS")
+
+	type testCase struct {
+		env        string
+		statusCode int
+		upgrade    string
+	}
+
+	cases := []testCase{
+		{"", http.StatusTeapot, ""},
+		{"418", http.StatusTeapot, ""},
+		{"426", http.StatusUpgradeRequired, "TLS/1.2, HTTP/1.1"},
+		{"500", http.StatusTeapot, ""},
+		{"bogus", http.StatusTeapot, ""},
+	}
+
+	for _, c := range cases {
+		os.Setenv("HTTP_REJECT_STATUS", c.env)
+		r := httptest.NewRequest("GET", "/challenge", nil)
+		r.Header.Set("X-Forwarded-Proto", "http")
+		w := serveTestHTTP(func(ctx *Context) StatusError { return nil }, r)
+
+		assert.Equal(t, c.statusCode, w.Code)
+		assert.Equal(t, c.upgrade, w.Header().Get("Upgrade"))
+		var body struct {
+			Code string `json:"code"`
+		}
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&body))
+		assert.Equal(t, CodeHTTPSRequired, body.Code)
+	}
+}
+
+func TestForwardedProto(t *testing.T) {
+	type testCase struct {
+		header string
+		ok     bool
+	}
+
+	cases := []testCase{
+		// A single element.
+		{"proto=https", true},
+		{"Proto=HTTPS", true},
+		{`proto="https"`, true},
+		{"for=192.0.2.60;proto=https;by=203.0.113.43", true},
+		{"proto=http", false},
+		// Multiple elements; only the first (client-nearest) is used.
+		{"proto=https, proto=http", true},
+		{"for=192.0.2.43;proto=https,for=198.51.100.17;proto=http", true},
+		{`for="[2001:db8::1],x";proto=https, proto=http`, true},
+		{"proto=http, proto=https", false},
+		// Malformed headers.
+		{"", false},
+		{"for=192.0.2.60", false},
+		{"xproto=https", false},
+		{"proto", false},
+		{"proto=", false},
+		{"=https", false},
+		{"proto=https;proto=https", false},
+		{`proto="https`, false},
+		{`for="x\";proto=https`, false},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/challenge", nil)
+		r.Header.Set("Forwarded", c.header)
+
+		err := checkHTTPS(r)
+		if c.ok {
+			assert.Nil(t, err, c.header)
+		} else if assert.NotNil(t, err, c.header) {
+			// Malformed headers are never internal errors.
+			assert.Equal(t, http.StatusTeapot, err.HTTPStatusCode(), c.header)
+		}
+	}
+}
+
+// errReader is an io.Reader which always fails.
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("entropy unavailable")
+}
+
+func TestTryReadCryptoRandBytes(t *testing.T) {
+	defer func(r io.Reader) { RandReader = r }(RandReader)
+
+	b := make([]byte, 16)
+	assert.Nil(t, TryReadCryptoRandBytes(b))
+
+	RandReader = errReader{}
+	err := TryReadCryptoRandBytes(b)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "entropy unavailable")
+	}
+	assert.Panics(t, func() { ReadCryptoRandBytes(b) })
+
+	// A short read is an error.
+	RandReader = strings.NewReader("short")
+	assert.NotNil(t, TryReadCryptoRandBytes(b))
+
+	// Requests are still served, with a non-random request ID.
+	RandReader = errReader{}
+	defer func(l *Logger) { DefaultLogger = l }(DefaultLogger)
+	DefaultLogger = NewLogger(ioutil.Discard)
+	w := serveTestHTTP(func(ctx *Context) StatusError { return nil }, newTestHTTPRequest("GET", "/challenge"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Header().Get("X-Request-Id"))
+}
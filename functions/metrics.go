@@ -0,0 +1,19 @@
+package functions
+
+import "upload-token.functions/internal/util"
+
+// MetricsHandler is a handler for the /metrics endpoint. It serves request
+// counts and latencies for the endpoints served by this process, and
+// proof-of-work validation metrics, in the Prometheus text exposition format.
+// Since the metrics reveal traffic and error rates, it is an administrative
+// endpoint (see util.RequireBearerToken).
+var MetricsHandler = util.MakeHTTPHandler(util.RequireBearerToken(metricsHandler))
+
+func metricsHandler(ctx *util.Context) util.StatusError {
+	if err := util.ValidateRequestMethod(ctx, "GET", ""); err != nil {
+		return err
+	}
+
+	util.DefaultMetrics.ServeHTTP(ctx.HTTPResponseWriter(), ctx.HTTPRequest())
+	return nil
+}
@@ -0,0 +1,45 @@
+package functions
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	os.Setenv("ADMIN_TOKEN", "secret")
+	defer os.Unsetenv("ADMIN_TOKEN")
+
+	type testCase struct {
+		authorization string
+		statusCode    int
+	}
+
+	cases := []testCase{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		r := newTestHTTPRequest("GET", "/metrics", nil)
+		if c.authorization != "" {
+			r.Header.Set("Authorization", c.authorization)
+		}
+		w := serveTestHTTP(MetricsHandler, r)
+		assert.Equal(t, c.statusCode, w.Code, c.authorization)
+		if c.statusCode == http.StatusOK {
+			assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+			assert.Contains(t, w.Body.String(), "# TYPE")
+		}
+	}
+
+	// The HTTPS requirement applies.
+	r := newTestHTTPRequest("GET", "/metrics", nil)
+	r.Header.Del("X-Forwarded-Proto")
+	r.Header.Set("Authorization", "Bearer secret")
+	w := serveTestHTTP(MetricsHandler, r)
+	assert.NotEqual(t, http.StatusOK, w.Code)
+}